@@ -0,0 +1,209 @@
+package audio
+
+import (
+	"bytes"
+	"time"
+)
+
+/*
+Frame is a single MP3 frame or Ogg page together with its playing time.
+*/
+type Frame struct {
+	// The raw bytes of the frame
+	Data []byte
+	// How long the audio in the frame plays, zero for Ogg header pages
+	Duration time.Duration
+}
+
+/*
+Framer splits a stream of bytes into complete frames.
+
+MP3 streams are split into MPEG audio frames, anything that isn't part of
+a frame (such as ID3 tags) is dropped. Ogg streams are split into pages.
+The data written doesn't have to be aligned in any way, incomplete frames
+are kept until the rest of them is pushed.
+*/
+type Framer struct {
+	// The format of the stream, "MP3" or "OGG"
+	Format string
+	// Bytes that are not part of a complete frame yet
+	buffer []byte
+	// Indicates if the last MP3 frame was followed by another frame
+	synced bool
+	// The granule rate of each Ogg logical stream
+	rates map[uint32]int
+	// The last granule position seen of each Ogg logical stream
+	granules map[uint32]int64
+	// The header pages of the Ogg stream
+	headers oggHeaders
+}
+
+/*
+Creates a new Framer for the format given, an empty format is treated as
+MP3 like everywhere else.
+*/
+func NewFramer(format string) *Framer {
+	if format != "OGG" {
+		format = "MP3"
+	}
+	return &Framer{Format: format,
+		rates:    make(map[uint32]int, 2),
+		granules: make(map[uint32]int64, 2)}
+}
+
+/*
+Adds data to the stream and returns all frames that have been completed
+by it. The data slices of the frames returned are never modified by the
+Framer afterwards.
+*/
+func (self *Framer) Push(data []byte) []Frame {
+	self.buffer = append(self.buffer, data...)
+
+	if self.Format == "OGG" {
+		return self.splitOgg()
+	}
+	return self.splitMP3()
+}
+
+/*
+Returns the header pages of the Ogg logical stream that started last, or
+nil if there are none. The slice returned is never modified afterwards.
+*/
+func (self *Framer) Headers() []byte {
+	return self.headers.complete
+}
+
+/*
+Returns the comments of the Ogg logical stream that started last, the
+second return value is false if there are none or they have been returned
+before.
+*/
+func (self *Framer) Comments() (OggComments, bool) {
+	if !self.headers.fresh {
+		return OggComments{}, false
+	}
+	self.headers.fresh = false
+
+	packets := OggPackets(self.headers.complete)
+	if len(packets) < 2 {
+		return OggComments{}, false
+	}
+	return ParseOggComments(packets[1])
+}
+
+func (self *Framer) splitMP3() (frames []Frame) {
+	for len(self.buffer) >= 4 {
+		if size := id3Size(self.buffer); size > 0 {
+			if len(self.buffer) < size {
+				break
+			}
+			self.buffer = self.buffer[size:]
+			continue
+		}
+
+		header, ok := ParseMP3Header(self.buffer)
+		if !ok {
+			self.resync()
+			continue
+		}
+
+		size := header.FrameSize()
+		if len(self.buffer) < size {
+			break
+		}
+
+		// Random data can look like a frame header, so when we aren't
+		// sure where we are in the stream the next frame has to be valid
+		// as well before we believe it.
+		if !self.synced {
+			if len(self.buffer) < size+4 {
+				break
+			}
+			if _, ok := ParseMP3Header(self.buffer[size:]); !ok {
+				self.resync()
+				continue
+			}
+		}
+
+		frames = append(frames, Frame{self.buffer[:size:size], header.Duration()})
+		self.buffer = self.buffer[size:]
+		self.synced = true
+	}
+	return frames
+}
+
+/*
+Drops bytes from the buffer until the next possible MP3 frame start.
+*/
+func (self *Framer) resync() {
+	self.synced = false
+	next := bytes.IndexByte(self.buffer[1:], 0xFF)
+	if next < 0 {
+		self.buffer = self.buffer[len(self.buffer):]
+		return
+	}
+	self.buffer = self.buffer[next+1:]
+}
+
+func (self *Framer) splitOgg() (frames []Frame) {
+	for len(self.buffer) >= oggHeaderSize {
+		start := bytes.Index(self.buffer, []byte("OggS"))
+		if start < 0 {
+			// Keep the tail, it might be the start of a capture pattern
+			self.buffer = self.buffer[len(self.buffer)-3:]
+			break
+		} else if start > 0 {
+			self.buffer = self.buffer[start:]
+			continue
+		}
+
+		page, ok := ParseOggPage(self.buffer)
+		if !ok {
+			if self.buffer[4] != 0 {
+				// Not a page after all
+				self.buffer = self.buffer[1:]
+				continue
+			}
+			break
+		}
+		if len(self.buffer) < page.Size {
+			break
+		}
+
+		data := self.buffer[:page.Size:page.Size]
+		frames = append(frames, Frame{data, self.oggDuration(page, data)})
+		self.headers.observe(page, data)
+		self.buffer = self.buffer[page.Size:]
+	}
+	return frames
+}
+
+/*
+Calculates the playing time of an Ogg page from the difference between
+its granule position and the one of the previous page of the stream.
+*/
+func (self *Framer) oggDuration(page OggPage, data []byte) time.Duration {
+	if page.Flags&OggBOS != 0 {
+		self.rates[page.Serial] = oggGranuleRate(data[page.HeaderSize:])
+		self.granules[page.Serial] = 0
+	}
+
+	rate := self.rates[page.Serial]
+	if page.Flags&OggEOS != 0 {
+		// The stream ends here, a new one will use a new serial.
+		delete(self.rates, page.Serial)
+		defer delete(self.granules, page.Serial)
+	}
+
+	if rate == 0 || page.Granule < 0 {
+		return 0
+	}
+
+	previous := self.granules[page.Serial]
+	self.granules[page.Serial] = page.Granule
+	if page.Granule < previous {
+		return 0
+	}
+	return time.Duration(page.Granule-previous) * time.Second /
+		time.Duration(rate)
+}
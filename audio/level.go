@@ -0,0 +1,215 @@
+/*
+Package audio contains the format level helpers used by the proxy, such as
+decoding the audio of a source to measure the signal level.
+
+Nothing in here talks to the network, the server package feeds the raw
+bytes received from source clients into the types of this package.
+*/
+package audio
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"sync/atomic"
+	"time"
+
+	"github.com/hajimehoshi/go-mp3"
+	"github.com/jfreymuth/oggvorbis"
+)
+
+// The level reported when no audio has been decoded yet, in dBFS.
+const SilentLevel = -96.0
+
+// The amount of windows measured per second of decoded audio.
+const windowsPerSecond = 10
+
+/*
+Meter decodes an audio stream in the background and keeps track of the
+signal level of it.
+
+All data written to the Meter is passed to a decoder running in its own
+goroutine. The level is measured as the RMS value of short windows of
+the decoded audio. Whenever a window is louder than the threshold the
+meter remembers the time, which is used to tell for how long the stream
+has been silent.
+*/
+type Meter struct {
+	// The threshold in dBFS below which the audio is considered silent.
+	Threshold float64
+	// The writing side of the pipe the decoder reads from.
+	writer *io.PipeWriter
+	// The level of the last measured window in hundredths of a dBFS.
+	level int64
+	// Time of the last window above the threshold, in unix nanoseconds.
+	lastSignal int64
+	// Set to one once the meter is closed.
+	closed int32
+}
+
+/*
+Creates a new Meter for the audio format given and starts decoding.
+
+format is one of the formats used by the proxy, "MP3" or "OGG". An empty
+format is treated as MP3. threshold is in dBFS.
+*/
+func NewMeter(format string, threshold float64) *Meter {
+	reader, writer := io.Pipe()
+
+	meter := &Meter{Threshold: threshold, writer: writer}
+	meter.setLevel(SilentLevel)
+	atomic.StoreInt64(&meter.lastSignal, time.Now().UnixNano())
+
+	if format == "OGG" {
+		go meter.decodeVorbis(reader)
+	} else {
+		go meter.decodeMP3(reader)
+	}
+	return meter
+}
+
+/*
+Passes data to the decoder. This blocks until the decoder has consumed it.
+
+Errors are returned when the meter has been closed, decoding errors are
+not reported and just restart the decoder.
+*/
+func (self *Meter) Write(data []byte) (int, error) {
+	return self.writer.Write(data)
+}
+
+/*
+Stops the decoder, any writes after this return an error.
+*/
+func (self *Meter) Close() error {
+	atomic.StoreInt32(&self.closed, 1)
+	return self.writer.Close()
+}
+
+func (self *Meter) isClosed() bool {
+	return atomic.LoadInt32(&self.closed) == 1
+}
+
+/*
+Returns the level of the last measured window in dBFS.
+*/
+func (self *Meter) Level() float64 {
+	return float64(atomic.LoadInt64(&self.level)) / 100
+}
+
+/*
+Returns the time since the audio was last above the threshold.
+*/
+func (self *Meter) SilentFor() time.Duration {
+	last := atomic.LoadInt64(&self.lastSignal)
+	return time.Since(time.Unix(0, last))
+}
+
+/*
+Forgets the silence measured so far, the stream counts as silent from now
+on instead.
+*/
+func (self *Meter) Reset() {
+	atomic.StoreInt64(&self.lastSignal, time.Now().UnixNano())
+}
+
+func (self *Meter) setLevel(level float64) {
+	atomic.StoreInt64(&self.level, int64(level*100))
+	if level >= self.Threshold {
+		atomic.StoreInt64(&self.lastSignal, time.Now().UnixNano())
+	}
+}
+
+/*
+Feeds a window of samples normalised to [-1, 1] into the meter.
+*/
+func (self *Meter) measure(sum float64, count int) {
+	if count == 0 {
+		return
+	}
+	rms := math.Sqrt(sum / float64(count))
+	level := SilentLevel
+	if rms > 0 {
+		level = math.Max(20*math.Log10(rms), SilentLevel)
+	}
+	self.setLevel(level)
+}
+
+/*
+Decodes MP3 data from the reader until it is closed. The decoder is
+recreated on errors so that it can resynchronise on broken streams.
+*/
+func (self *Meter) decodeMP3(reader *io.PipeReader) {
+	defer reader.Close()
+
+	buffer := make([]byte, 4096)
+	for {
+		decoder, err := mp3.NewDecoder(reader)
+		if err != nil {
+			if self.isClosed() {
+				return
+			}
+			continue
+		}
+
+		// The decoder always returns 16bit little endian stereo samples.
+		window := decoder.SampleRate() / windowsPerSecond * 2
+		sum, count := 0.0, 0
+		for {
+			n, err := decoder.Read(buffer)
+			for i := 0; i+1 < n; i += 2 {
+				sample := float64(int16(binary.LittleEndian.Uint16(buffer[i:])))
+				sample /= math.MaxInt16
+				sum += sample * sample
+				if count++; count >= window {
+					self.measure(sum, count)
+					sum, count = 0.0, 0
+				}
+			}
+			if err != nil {
+				if self.isClosed() {
+					return
+				}
+				break
+			}
+		}
+	}
+}
+
+/*
+Decodes Ogg/Vorbis data from the reader until it is closed. A new decoder
+is created for each chained stream and on errors.
+*/
+func (self *Meter) decodeVorbis(reader *io.PipeReader) {
+	defer reader.Close()
+
+	buffer := make([]float32, 4096)
+	for {
+		decoder, err := oggvorbis.NewReader(reader)
+		if err != nil {
+			if self.isClosed() {
+				return
+			}
+			continue
+		}
+
+		window := decoder.SampleRate() / windowsPerSecond * decoder.Channels()
+		sum, count := 0.0, 0
+		for {
+			n, err := decoder.Read(buffer)
+			for _, sample := range buffer[:n] {
+				sum += float64(sample) * float64(sample)
+				if count++; count >= window {
+					self.measure(sum, count)
+					sum, count = 0.0, 0
+				}
+			}
+			if err != nil {
+				if self.isClosed() {
+					return
+				}
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package audio
+
+import (
+	"time"
+)
+
+// MPEG audio versions as stored in the frame header.
+const (
+	MPEG25 = 0
+	MPEG2  = 2
+	MPEG1  = 3
+)
+
+// MPEG audio layers as stored in the frame header.
+const (
+	LayerIII = 1
+	LayerII  = 2
+	LayerI   = 3
+)
+
+// Bitrates in kbit/s indexed by [version is MPEG1][layer][index]
+var mp3Bitrates = [2][4][16]int{
+	{ // MPEG2 and MPEG2.5
+		{},
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0},
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0},
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256, 0},
+	},
+	{ // MPEG1
+		{},
+		{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 0},
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384, 0},
+		{0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448, 0},
+	},
+}
+
+// Sample rates indexed by [version][index]
+var mp3SampleRates = [4][3]int{
+	MPEG25: {11025, 12000, 8000},
+	MPEG2:  {22050, 24000, 16000},
+	MPEG1:  {44100, 48000, 32000},
+}
+
+/*
+MP3Header is a parsed MPEG audio frame header.
+*/
+type MP3Header struct {
+	// One of MPEG1, MPEG2 or MPEG25
+	Version int
+	// One of LayerI, LayerII or LayerIII
+	Layer int
+	// Bitrate in kbit/s
+	Bitrate int
+	// Sample rate in Hz
+	SampleRate int
+	// Indicates if the frame has an extra padding slot
+	Padding bool
+	// Indicates if a CRC follows the header
+	Protected bool
+	// The amount of audio channels
+	Channels int
+	// The header as it appeared in the stream
+	Raw [4]byte
+}
+
+/*
+Parses the four byte frame header at the start of data. The second return
+value is false if data doesn't start with a valid header.
+
+Free format frames are not supported and reported as invalid.
+*/
+func ParseMP3Header(data []byte) (header MP3Header, ok bool) {
+	if len(data) < 4 || data[0] != 0xFF || data[1]&0xE0 != 0xE0 {
+		return header, false
+	}
+
+	header.Version = int(data[1]>>3) & 3
+	header.Layer = int(data[1]>>1) & 3
+	if header.Version == 1 || header.Layer == 0 {
+		return header, false
+	}
+
+	bitrate, samplerate := int(data[2]>>4), int(data[2]>>2)&3
+	if bitrate == 0 || bitrate == 15 || samplerate == 3 {
+		return header, false
+	}
+
+	mpeg1 := 0
+	if header.Version == MPEG1 {
+		mpeg1 = 1
+	}
+	header.Bitrate = mp3Bitrates[mpeg1][header.Layer][bitrate]
+	header.SampleRate = mp3SampleRates[header.Version][samplerate]
+	header.Padding = data[2]&2 != 0
+	header.Protected = data[1]&1 == 0
+	header.Channels = 2
+	if data[3]>>6 == 3 {
+		header.Channels = 1
+	}
+	copy(header.Raw[:], data[:4])
+	return header, true
+}
+
+/*
+Returns the amount of samples per channel contained in the frame.
+*/
+func (self MP3Header) Samples() int {
+	switch {
+	case self.Layer == LayerI:
+		return 384
+	case self.Layer == LayerIII && self.Version != MPEG1:
+		return 576
+	}
+	return 1152
+}
+
+/*
+Returns the size of the frame in bytes, including the header.
+*/
+func (self MP3Header) FrameSize() int {
+	padding := 0
+	if self.Padding {
+		padding = 1
+	}
+	if self.Layer == LayerI {
+		return (12*self.Bitrate*1000/self.SampleRate + padding) * 4
+	}
+	return self.Samples()/8*self.Bitrate*1000/self.SampleRate + padding
+}
+
+/*
+Returns the playing time of the frame.
+*/
+func (self MP3Header) Duration() time.Duration {
+	return time.Duration(self.Samples()) * time.Second /
+		time.Duration(self.SampleRate)
+}
+
+/*
+Returns the size of an ID3v2 tag at the start of data, or zero if there
+is none. The size returned includes the tag header and footer.
+*/
+func id3Size(data []byte) int {
+	if len(data) < 10 || string(data[:3]) != "ID3" {
+		return 0
+	}
+	// The size is stored as a syncsafe integer, 7 bits per byte.
+	size := int(data[6]&0x7F)<<21 | int(data[7]&0x7F)<<14 |
+		int(data[8]&0x7F)<<7 | int(data[9]&0x7F)
+	size += 10
+	if data[5]&0x10 != 0 {
+		// There is a footer as well
+		size += 10
+	}
+	return size
+}
@@ -0,0 +1,222 @@
+package audio
+
+import (
+	"encoding/binary"
+)
+
+// Flags in the header type field of an Ogg page.
+const (
+	OggContinued = 0x01
+	OggBOS       = 0x02
+	OggEOS       = 0x04
+)
+
+// The size of an Ogg page header without the segment table.
+const oggHeaderSize = 27
+
+/*
+OggPage is a parsed Ogg page header.
+*/
+type OggPage struct {
+	// Header type flags, see OggBOS and friends
+	Flags byte
+	// The granule position of the last packet finishing on this page,
+	// -1 if no packet finishes on it
+	Granule int64
+	// The serial number of the logical stream this page belongs to
+	Serial uint32
+	// The page sequence number
+	Sequence uint32
+	// The size of the page header including the segment table
+	HeaderSize int
+	// The size of the whole page
+	Size int
+}
+
+/*
+Parses the Ogg page header at the start of data. The second return value
+is false if data doesn't start with a complete page header.
+*/
+func ParseOggPage(data []byte) (page OggPage, ok bool) {
+	if len(data) < oggHeaderSize || string(data[:4]) != "OggS" || data[4] != 0 {
+		return page, false
+	}
+
+	segments := int(data[26])
+	if len(data) < oggHeaderSize+segments {
+		return page, false
+	}
+
+	page.Flags = data[5]
+	page.Granule = int64(binary.LittleEndian.Uint64(data[6:]))
+	page.Serial = binary.LittleEndian.Uint32(data[14:])
+	page.Sequence = binary.LittleEndian.Uint32(data[18:])
+	page.HeaderSize = oggHeaderSize + segments
+	page.Size = page.HeaderSize
+	for _, length := range data[oggHeaderSize:page.HeaderSize] {
+		page.Size += int(length)
+	}
+	return page, true
+}
+
+/*
+Returns the granule rate of a logical stream given the first packet of
+it, zero is returned for codecs we don't know.
+*/
+func oggGranuleRate(packet []byte) int {
+	switch {
+	case len(packet) >= 16 && string(packet[:7]) == "\x01vorbis":
+		return int(binary.LittleEndian.Uint32(packet[12:]))
+	case len(packet) >= 8 && string(packet[:8]) == "OpusHead":
+		// Opus always uses a 48kHz granule position
+		return 48000
+	}
+	return 0
+}
+
+// The CRC lookup table used for Ogg page checksums.
+var oggCRCTable [256]uint32
+
+func init() {
+	for i := range oggCRCTable {
+		r := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if r&0x80000000 != 0 {
+				r = r<<1 ^ 0x04C11DB7
+			} else {
+				r <<= 1
+			}
+		}
+		oggCRCTable[i] = r
+	}
+}
+
+/*
+Builds a complete Ogg page containing the packets given. The packets have
+to fit into a single page, which means 255 lacing values at most.
+*/
+func BuildOggPage(flags byte, granule int64, serial uint32, sequence uint32,
+	packets [][]byte) []byte {
+
+	lacing := make([]byte, 0, len(packets))
+	size := 0
+	for _, packet := range packets {
+		for i := len(packet); i >= 0; i -= 255 {
+			if i >= 255 {
+				lacing = append(lacing, 255)
+			} else {
+				lacing = append(lacing, byte(i))
+			}
+		}
+		size += len(packet)
+	}
+
+	page := make([]byte, oggHeaderSize, oggHeaderSize+len(lacing)+size)
+	copy(page, "OggS")
+	page[5] = flags
+	binary.LittleEndian.PutUint64(page[6:], uint64(granule))
+	binary.LittleEndian.PutUint32(page[14:], serial)
+	binary.LittleEndian.PutUint32(page[18:], sequence)
+	page[26] = byte(len(lacing))
+	page = append(page, lacing...)
+	for _, packet := range packets {
+		page = append(page, packet...)
+	}
+
+	setOggChecksum(page)
+	return page
+}
+
+/*
+Calculates the checksum of a complete Ogg page and stores it in the page.
+*/
+func setOggChecksum(page []byte) {
+	binary.LittleEndian.PutUint32(page[22:], 0)
+
+	var crc uint32
+	for _, b := range page {
+		crc = crc<<8 ^ oggCRCTable[byte(crc>>24)^b]
+	}
+	binary.LittleEndian.PutUint32(page[22:], crc)
+}
+
+/*
+Returns the packets that start and finish in the pages given, packets
+continued from an earlier page are skipped.
+*/
+func OggPackets(data []byte) (packets [][]byte) {
+	var packet []byte
+	continued := false
+	for len(data) > 0 {
+		page, ok := ParseOggPage(data)
+		if !ok || len(data) < page.Size {
+			break
+		}
+
+		// A continued page without a packet in progress belongs to a
+		// packet we never saw the start of.
+		skip := page.Flags&OggContinued != 0 && !continued
+		body := data[page.HeaderSize:page.Size]
+		for _, length := range data[oggHeaderSize:page.HeaderSize] {
+			if !skip {
+				packet = append(packet, body[:length]...)
+			}
+			body = body[length:]
+			continued = length == 255
+			if !continued {
+				if !skip {
+					packets = append(packets, packet)
+				}
+				packet, skip = nil, false
+			}
+		}
+		data = data[page.Size:]
+	}
+	return packets
+}
+
+/*
+Returns true if data starts with the first page of a logical stream.
+*/
+func IsOggBOS(data []byte) bool {
+	page, ok := ParseOggPage(data)
+	return ok && page.Flags&OggBOS != 0
+}
+
+/*
+oggHeaders collects the header pages of the logical streams in an Ogg
+stream. These are needed by anyone that wants to start decoding halfway.
+*/
+type oggHeaders struct {
+	// The header pages collected so far of the stream that started last
+	pages []byte
+	// Indicates if we are still collecting header pages
+	collecting bool
+	// The header pages of the last stream that was fully collected
+	complete []byte
+	// Set when complete changed since the comments were last asked for
+	fresh bool
+}
+
+/*
+Looks at a page of the stream. Header pages are recognised by their zero
+granule position, the first page with a different one is audio.
+*/
+func (self *oggHeaders) observe(page OggPage, data []byte) {
+	if page.Flags&OggBOS != 0 && !self.collecting {
+		self.pages = nil
+		self.collecting = true
+	}
+	if !self.collecting {
+		return
+	}
+
+	if page.Granule != 0 {
+		self.complete = self.pages
+		self.fresh = true
+		self.pages = nil
+		self.collecting = false
+		return
+	}
+	self.pages = append(self.pages, data...)
+}
@@ -0,0 +1,435 @@
+package audio
+
+import (
+	"encoding/binary"
+	"sort"
+	"strings"
+)
+
+// The largest packet that fits into a single Ogg page.
+const maxPagePacket = 255*255 - 1
+
+/*
+OggComments is the comment header of a Vorbis or Opus stream.
+*/
+type OggComments struct {
+	// The vendor string of the encoder
+	Vendor string
+	// The comments in the order of the stream, as "KEY=value"
+	Comments []string
+	// Indicates if the header belongs to a Vorbis stream, Opus otherwise
+	vorbis bool
+}
+
+/*
+Parses a Vorbis or Opus comment header packet. The second return value is
+false if the packet isn't one.
+*/
+func ParseOggComments(packet []byte) (comments OggComments, ok bool) {
+	switch {
+	case len(packet) >= 7 && string(packet[:7]) == "\x03vorbis":
+		comments.vorbis = true
+		packet = packet[7:]
+	case len(packet) >= 8 && string(packet[:8]) == "OpusTags":
+		packet = packet[8:]
+	default:
+		return comments, false
+	}
+
+	if comments.Vendor, packet, ok = readOggString(packet); !ok {
+		return comments, false
+	}
+	if len(packet) < 4 {
+		return comments, false
+	}
+	count := binary.LittleEndian.Uint32(packet)
+	packet = packet[4:]
+	for i := uint32(0); i < count; i++ {
+		var comment string
+		if comment, packet, ok = readOggString(packet); !ok {
+			return comments, false
+		}
+		comments.Comments = append(comments.Comments, comment)
+	}
+	return comments, true
+}
+
+func readOggString(data []byte) (string, []byte, bool) {
+	if len(data) < 4 {
+		return "", data, false
+	}
+	length := binary.LittleEndian.Uint32(data)
+	if uint64(len(data)-4) < uint64(length) {
+		return "", data, false
+	}
+	return string(data[4 : 4+length]), data[4+length:], true
+}
+
+func appendOggString(data []byte, value string) []byte {
+	var length [4]byte
+	binary.LittleEndian.PutUint32(length[:], uint32(len(value)))
+	return append(append(data, length[:]...), value...)
+}
+
+/*
+Returns the value of the first comment with the key given, keys are case
+insensitive.
+*/
+func (self OggComments) Get(key string) string {
+	for _, comment := range self.Comments {
+		if i := strings.IndexByte(comment, '='); i >= 0 &&
+			strings.EqualFold(comment[:i], key) {
+			return comment[i+1:]
+		}
+	}
+	return ""
+}
+
+/*
+Replaces all comments with the key given by one with the value given, or
+removes them if the value is "".
+*/
+func (self *OggComments) Set(key string, value string) {
+	comments := make([]string, 0, len(self.Comments)+1)
+	for _, comment := range self.Comments {
+		if i := strings.IndexByte(comment, '='); i >= 0 &&
+			strings.EqualFold(comment[:i], key) {
+			continue
+		}
+		comments = append(comments, comment)
+	}
+	if value != "" {
+		comments = append(comments, strings.ToUpper(key)+"="+value)
+	}
+	self.Comments = comments
+}
+
+/*
+Returns the comment header as a packet.
+*/
+func (self OggComments) Packet() []byte {
+	var packet []byte
+	if self.vorbis {
+		packet = append(packet, "\x03vorbis"...)
+	} else {
+		packet = append(packet, "OpusTags"...)
+	}
+
+	packet = appendOggString(packet, self.Vendor)
+	var count [4]byte
+	binary.LittleEndian.PutUint32(count[:], uint32(len(self.Comments)))
+	packet = append(packet, count[:]...)
+	for _, comment := range self.Comments {
+		packet = appendOggString(packet, comment)
+	}
+
+	if self.vorbis {
+		// The framing bit
+		packet = append(packet, 1)
+	}
+	return packet
+}
+
+/*
+Returns the amount of header packets of a logical stream given its first
+packet, zero for codecs that don't have a comment header we know of.
+*/
+func oggHeaderPackets(packet []byte) int {
+	switch {
+	case len(packet) >= 7 && string(packet[:7]) == "\x01vorbis":
+		return 3
+	case len(packet) >= 8 && string(packet[:8]) == "OpusHead":
+		return 2
+	}
+	return 0
+}
+
+/*
+OggTagger changes the comments of a Vorbis or Opus stream as it passes.
+
+Comments can only be set in the headers of a logical stream, so when the
+comments of the stream passing don't match the tags set the tagger ends
+the stream going out and starts a new logical stream at the next packet
+boundary. It consists of the headers of the stream passing with the tags
+applied, followed by the rest of the stream moved over to the new serial
+number. Players see this as a chained stream and lose no more than the few
+milliseconds a decoder needs to get going again.
+
+A stream that starts while tags are set has its comment header replaced
+right away, there's no need to chain another stream after it.
+*/
+type OggTagger struct {
+	// The tags to apply to the streams passing, nil if there are none
+	tags map[string]string
+	// The serial number of the logical stream coming in
+	serial uint32
+	// The amount of header packets of that stream, zero if we can't tag it
+	needed int
+	// The header pages of the stream seen so far
+	pages []byte
+	// The header packets of the stream, once all of them have been seen
+	headers [][]byte
+	// The comments of the stream going out
+	comments OggComments
+	// Indicates if the stream going out has a serial of its own
+	moved bool
+	// The serial number of the stream going out
+	outSerial uint32
+	// The sequence number of the next page of the stream going out
+	sequence uint32
+	// The granule position of the last page of the stream going out
+	granule int64
+	// Set when the stream can't be tagged, such as when its headers don't
+	// fit into single pages
+	failed bool
+	// Set when the stream going out has to start over, see Reset
+	restart bool
+}
+
+/*
+Creates a new OggTagger without any tags.
+*/
+func NewOggTagger() *OggTagger {
+	return &OggTagger{}
+}
+
+/*
+Sets the tags applied to the streams passing from now on, such as "TITLE"
+and "ARTIST". A tag with an empty value removes the comments with that
+key, and nil stops any tagging.
+*/
+func (self *OggTagger) SetTags(tags map[string]string) {
+	self.tags = tags
+}
+
+/*
+Starts the stream going out over at the next packet boundary, with the
+headers of the stream passing and the tags applied. This is needed when
+whoever receives the stream missed its start, such as after reconnecting.
+
+Returns false if the tagger can't do so, because it doesn't know the
+headers or can't tag the stream. The headers have to be sent again by the
+caller in that case.
+*/
+func (self *OggTagger) Reset() bool {
+	if self.needed == 0 || self.failed {
+		return false
+	}
+	if len(self.headers) < self.needed {
+		// The header pages are still held back, they go out in full
+		return true
+	}
+	self.restart = true
+	return true
+}
+
+/*
+Passes page aligned data through the tagger and returns the data to send
+in its place. Data that isn't page aligned is passed on as is.
+*/
+func (self *OggTagger) Process(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	for len(data) > 0 {
+		page, ok := ParseOggPage(data)
+		if !ok || len(data) < page.Size {
+			return append(out, data...)
+		}
+		out = append(out, self.page(page, data[:page.Size])...)
+		data = data[page.Size:]
+	}
+	return out
+}
+
+func (self *OggTagger) page(page OggPage, data []byte) []byte {
+	if page.Flags&OggBOS != 0 {
+		self.start(page, data)
+	}
+	if page.Serial != self.serial || self.needed == 0 {
+		// Streams we can't tag, or another stream multiplexed with ours
+		return data
+	}
+
+	if len(self.headers) < self.needed {
+		return self.collect(data)
+	}
+
+	// A new stream has to start with a new packet
+	var out []byte
+	if page.Flags&OggContinued == 0 && !self.failed &&
+		(self.restart || !self.tagged()) {
+		out = self.rechain(page)
+	}
+	if page.Granule != -1 {
+		self.granule = page.Granule
+	}
+	return append(out, self.move(data)...)
+}
+
+/*
+Starts following the logical stream starting with the page given, unless
+it is of a codec we can't tag.
+*/
+func (self *OggTagger) start(page OggPage, data []byte) {
+	needed := oggHeaderPackets(data[page.HeaderSize:])
+	if needed == 0 {
+		return
+	}
+	self.serial = page.Serial
+	self.needed = needed
+	self.pages = nil
+	self.headers = nil
+	self.comments = OggComments{}
+	self.moved = false
+	self.outSerial = page.Serial
+	self.granule = 0
+	self.failed = false
+	self.restart = false
+}
+
+/*
+Collects the header packets of the stream from its pages. The pages are
+held back until all header packets have been seen, they are returned then
+with the tags applied to the comment header.
+*/
+func (self *OggTagger) collect(data []byte) []byte {
+	self.pages = append(self.pages, data...)
+	packets := OggPackets(self.pages)
+	if len(packets) < self.needed {
+		return nil
+	}
+
+	pages := self.pages
+	self.headers = packets[:self.needed]
+	self.pages = nil
+	comments, ok := ParseOggComments(self.headers[1])
+	if !ok {
+		self.failed = true
+		return pages
+	}
+	self.comments = comments
+	if self.tagged() {
+		return pages
+	}
+
+	// The pages after the headers are moved over to the numbering of
+	// our headers, the serial stays the same.
+	if tagged := self.headerPages(self.serial); tagged != nil {
+		return tagged
+	}
+	return pages
+}
+
+/*
+Returns true if the comments of the stream going out match the tags.
+*/
+func (self *OggTagger) tagged() bool {
+	for key, value := range self.tags {
+		if self.comments.Get(key) != value {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+Ends the stream going out and returns it along with the header pages of a
+new logical stream with the tags applied, the pages of the stream passing
+are moved over to it from now on. page is the page of the stream passing
+the new stream starts with. A stream that starts over isn't ended, the
+receiver never saw its start.
+*/
+func (self *OggTagger) rechain(page OggPage) []byte {
+	// The stream going out is either the stream passing, which page would
+	// have continued, or one we moved it over to.
+	sequence := page.Sequence
+	if self.moved {
+		sequence = self.sequence
+	}
+	var end []byte
+	if !self.restart {
+		end = BuildOggPage(OggEOS, self.granule, self.outSerial, sequence, nil)
+	}
+	self.restart = false
+
+	serial := self.outSerial + 1
+	if serial == self.serial {
+		serial++
+	}
+	headers := self.headerPages(serial)
+	if headers == nil {
+		return nil
+	}
+	return append(end, headers...)
+}
+
+/*
+Returns the header pages of the stream passing with the tags applied, as
+the start of the logical stream with the serial given. The pages of the
+stream passing are moved over to it from now on. Returns nil if the
+headers can't be tagged.
+*/
+func (self *OggTagger) headerPages(serial uint32) []byte {
+	// Keep the order of the comments the same every time
+	keys := make([]string, 0, len(self.tags))
+	for key := range self.tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	comments := OggComments{Vendor: self.comments.Vendor,
+		Comments: append([]string(nil), self.comments.Comments...),
+		vorbis:   self.comments.vorbis}
+	for _, key := range keys {
+		comments.Set(key, self.tags[key])
+	}
+
+	packet := comments.Packet()
+	if len(packet) > maxPagePacket {
+		// Most likely cover art, which we can live without
+		comments.Comments = nil
+		for _, key := range keys {
+			comments.Set(key, self.tags[key])
+		}
+		packet = comments.Packet()
+	}
+
+	packets := append([][]byte{self.headers[0], packet}, self.headers[2:]...)
+	for _, packet := range packets {
+		if len(packet) > maxPagePacket {
+			self.failed = true
+			return nil
+		}
+	}
+
+	var out []byte
+	for i, packet := range packets {
+		var flags byte
+		if i == 0 {
+			flags = OggBOS
+		}
+		out = append(out, BuildOggPage(flags, 0, serial, uint32(i),
+			[][]byte{packet})...)
+	}
+
+	self.comments = comments
+	self.moved = true
+	self.outSerial = serial
+	self.sequence = uint32(len(packets))
+	return out
+}
+
+/*
+Moves a page of the stream passing over to the stream going out.
+*/
+func (self *OggTagger) move(data []byte) []byte {
+	if !self.moved {
+		return data
+	}
+
+	page := append([]byte(nil), data...)
+	binary.LittleEndian.PutUint32(page[14:], self.outSerial)
+	binary.LittleEndian.PutUint32(page[18:], self.sequence)
+	setOggChecksum(page)
+	self.sequence++
+	return page
+}
@@ -0,0 +1,287 @@
+package audio
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+const testSerial = 0x1234
+
+// Header packets of a Vorbis stream, only the parts the tagger looks at
+// are real.
+var (
+	vorbisID      = append([]byte("\x01vorbis"), make([]byte, 23)...)
+	vorbisComment = OggComments{Vendor: "test", Comments: []string{"TITLE=Old", "ALBUM=Album"},
+		vorbis: true}.Packet()
+	vorbisSetup = append([]byte("\x05vorbis"), make([]byte, 100)...)
+)
+
+/*
+Returns the pages of a Vorbis stream with the headers given and the audio
+packets after it, one packet per page.
+*/
+func testStream(serial uint32, comment []byte, audio int) [][]byte {
+	pages := [][]byte{
+		BuildOggPage(OggBOS, 0, serial, 0, [][]byte{vorbisID}),
+		BuildOggPage(0, 0, serial, 1, [][]byte{comment, vorbisSetup}),
+	}
+	for i := 0; i < audio; i++ {
+		packet := bytes.Repeat([]byte{byte(i)}, 100)
+		pages = append(pages, BuildOggPage(0, int64(i+1)*1024, serial,
+			uint32(len(pages)), [][]byte{packet}))
+	}
+	return pages
+}
+
+/*
+Splits the data returned by the tagger into pages and checks their
+checksums.
+*/
+func splitPages(t *testing.T, data []byte) ([]OggPage, [][]byte) {
+	var pages []OggPage
+	var raw [][]byte
+	for len(data) > 0 {
+		page, ok := ParseOggPage(data)
+		if !ok || len(data) < page.Size {
+			t.Fatalf("incomplete page in output")
+		}
+		check := append([]byte(nil), data[:page.Size]...)
+		setOggChecksum(check)
+		if !bytes.Equal(check, data[:page.Size]) {
+			t.Errorf("page %d has a bad checksum", len(pages))
+		}
+		pages = append(pages, page)
+		raw = append(raw, data[:page.Size])
+		data = data[page.Size:]
+	}
+	return pages, raw
+}
+
+func TestOggCommentsRoundTrip(t *testing.T) {
+	for _, vorbis := range []bool{true, false} {
+		comments := OggComments{Vendor: "encoder 1.0",
+			Comments: []string{"TITLE=Title", "artist=Artist", "EMPTY="},
+			vorbis:   vorbis}
+		packet := comments.Packet()
+		parsed, ok := ParseOggComments(packet)
+		if !ok {
+			t.Fatalf("vorbis %v: packet didn't parse", vorbis)
+		}
+		if !reflect.DeepEqual(parsed, comments) {
+			t.Errorf("vorbis %v: got %#v, want %#v", vorbis, parsed, comments)
+		}
+		if !bytes.Equal(parsed.Packet(), packet) {
+			t.Errorf("vorbis %v: packet changed after a round trip", vorbis)
+		}
+
+		if value := parsed.Get("ARTIST"); value != "Artist" {
+			t.Errorf("vorbis %v: Get is case sensitive, got %q", vorbis, value)
+		}
+		parsed.Set("Title", "New")
+		parsed.Set("artist", "")
+		want := []string{"EMPTY=", "TITLE=New"}
+		if !reflect.DeepEqual(parsed.Comments, want) {
+			t.Errorf("vorbis %v: after Set got %q, want %q", vorbis,
+				parsed.Comments, want)
+		}
+	}
+
+	if _, ok := ParseOggComments([]byte("\x03vorbis\xff\xff\xff\xff")); ok {
+		t.Error("a truncated packet parsed")
+	}
+	if _, ok := ParseOggComments(vorbisID); ok {
+		t.Error("an identification header parsed as comments")
+	}
+}
+
+func TestOggTaggerPassesUntagged(t *testing.T) {
+	tagger := NewOggTagger()
+	var in, out []byte
+	for _, page := range testStream(testSerial, vorbisComment, 3) {
+		in = append(in, page...)
+		out = append(out, tagger.Process(page)...)
+	}
+	if !bytes.Equal(out, in) {
+		t.Errorf("stream changed without tags")
+	}
+}
+
+func TestOggTaggerRechain(t *testing.T) {
+	stream := testStream(testSerial, vorbisComment, 4)
+	tagger := NewOggTagger()
+	for _, page := range stream[:3] {
+		tagger.Process(page)
+	}
+
+	tagger.SetTags(map[string]string{"TITLE": "New"})
+	pages, raw := splitPages(t, tagger.Process(stream[3]))
+	if len(pages) != 5 {
+		t.Fatalf("got %d pages, want an EOS page, 3 header pages and the audio",
+			len(pages))
+	}
+
+	// The old stream is ended where the page passing would have continued it
+	end := pages[0]
+	if end.Serial != testSerial || end.Flags != OggEOS || end.Sequence != 3 ||
+		end.Granule != 1024 || end.Size != end.HeaderSize {
+		t.Errorf("bad EOS page %+v", end)
+	}
+
+	serial := pages[1].Serial
+	if serial == testSerial {
+		t.Fatalf("new stream kept the serial of the old one")
+	}
+	for i, page := range pages[1:] {
+		if page.Serial != serial || page.Sequence != uint32(i) {
+			t.Errorf("page %d: serial %x sequence %d, want %x and %d", i+1,
+				page.Serial, page.Sequence, serial, i)
+		}
+		if bos := page.Flags&OggBOS != 0; bos != (i == 0) {
+			t.Errorf("page %d: BOS flag %v", i+1, bos)
+		}
+	}
+
+	var headers []byte
+	for _, page := range raw[1:4] {
+		headers = append(headers, page...)
+	}
+	packets := OggPackets(headers)
+	if len(packets) != 3 || !bytes.Equal(packets[0], vorbisID) ||
+		!bytes.Equal(packets[2], vorbisSetup) {
+		t.Fatalf("headers weren't carried over")
+	}
+	comments, ok := ParseOggComments(packets[1])
+	if !ok || comments.Get("TITLE") != "New" || comments.Get("ALBUM") != "Album" {
+		t.Errorf("bad comments %q", comments.Comments)
+	}
+
+	// The audio is the same apart from the serial and sequence
+	moved := raw[4]
+	if !bytes.Equal(moved[moved[26]+27:], stream[3][stream[3][26]+27:]) ||
+		pages[4].Granule != 2048 {
+		t.Errorf("audio page changed")
+	}
+
+	// Once tagged the rest of the stream is only moved
+	pages, _ = splitPages(t, tagger.Process(stream[4]))
+	if len(pages) != 1 || pages[0].Serial != serial || pages[0].Sequence != 4 {
+		t.Errorf("got %+v, want the audio page moved to sequence 4", pages)
+	}
+}
+
+func TestOggTaggerRechainsOnPacketBoundary(t *testing.T) {
+	stream := testStream(testSerial, vorbisComment, 1)
+	tagger := NewOggTagger()
+	for _, page := range stream {
+		tagger.Process(page)
+	}
+
+	// A packet split over two pages
+	packet := bytes.Repeat([]byte{0xaa}, 600)
+	first := BuildOggPage(0, -1, testSerial, 3, [][]byte{packet[:510]})
+	// BuildOggPage ends a packet of 510 bytes with a zero lacing value,
+	// drop it so the packet carries on in the next page.
+	first = append(first[:26:26], append([]byte{2, 255, 255}, first[30:]...)...)
+	setOggChecksum(first)
+	second := BuildOggPage(OggContinued, 4096, testSerial, 4, [][]byte{packet[510:]})
+
+	if out := tagger.Process(first); !bytes.Equal(out, first) {
+		t.Fatalf("page changed without tags")
+	}
+	tagger.SetTags(map[string]string{"TITLE": "New"})
+	if out := tagger.Process(second); !bytes.Equal(out, second) {
+		t.Errorf("rechained in the middle of a packet")
+	}
+	if packets := OggPackets(append(first, second...)); len(packets) != 1 ||
+		!bytes.Equal(packets[0], packet) {
+		t.Fatalf("test pages don't hold the packet")
+	}
+
+	next := BuildOggPage(0, 5120, testSerial, 5, [][]byte{{1, 2, 3}})
+	pages, _ := splitPages(t, tagger.Process(next))
+	if len(pages) != 5 || pages[0].Flags != OggEOS || pages[0].Sequence != 5 ||
+		pages[0].Granule != 4096 {
+		t.Errorf("didn't rechain on the next packet boundary, got %+v", pages)
+	}
+}
+
+func TestOggTaggerChainedSource(t *testing.T) {
+	tagger := NewOggTagger()
+	tagger.SetTags(map[string]string{"TITLE": "New"})
+
+	stream := testStream(testSerial, vorbisComment, 2)
+	var out []byte
+	for i, page := range stream[:2] {
+		data := tagger.Process(page)
+		if i == 0 && len(data) != 0 {
+			t.Errorf("header page passed before all headers were seen")
+		}
+		out = append(out, data...)
+	}
+	for _, page := range stream[2:] {
+		out = append(out, tagger.Process(page)...)
+	}
+
+	pages, raw := splitPages(t, out)
+	if len(pages) != 5 {
+		t.Fatalf("got %d pages, want 3 header pages and 2 audio pages", len(pages))
+	}
+	for i, page := range pages {
+		if page.Serial != testSerial || page.Sequence != uint32(i) {
+			t.Errorf("page %d: serial %x sequence %d", i, page.Serial, page.Sequence)
+		}
+		if page.Flags&OggEOS != 0 {
+			t.Errorf("page %d: a new stream was ended", i)
+		}
+	}
+
+	var all []byte
+	for _, page := range raw {
+		all = append(all, page...)
+	}
+	packets := OggPackets(all)
+	comments, ok := ParseOggComments(packets[1])
+	if !ok || comments.Get("TITLE") != "New" {
+		t.Errorf("comment header wasn't replaced, got %q", comments.Comments)
+	}
+	for _, packet := range packets[3:] {
+		if _, ok := ParseOggComments(packet); ok || bytes.Equal(packet, vorbisID) {
+			t.Errorf("a second set of headers followed")
+		}
+	}
+}
+
+func TestOggTaggerReset(t *testing.T) {
+	stream := testStream(testSerial, vorbisComment, 3)
+	tagger := NewOggTagger()
+	tagger.SetTags(map[string]string{"TITLE": "Old"})
+	for _, page := range stream[:3] {
+		tagger.Process(page)
+	}
+
+	if !tagger.Reset() {
+		t.Fatalf("tagger can't start over")
+	}
+	pages, raw := splitPages(t, tagger.Process(stream[3]))
+	if len(pages) != 4 || pages[0].Flags != OggBOS {
+		t.Fatalf("got %+v, want 3 header pages and the audio without an EOS", pages)
+	}
+	var all []byte
+	for _, page := range raw {
+		all = append(all, page...)
+	}
+	comments, ok := ParseOggComments(OggPackets(all)[1])
+	if !ok || comments.Get("TITLE") != "Old" || comments.Get("ALBUM") != "Album" {
+		t.Errorf("headers didn't keep the tags, got %q", comments.Comments)
+	}
+	for i, page := range pages {
+		if page.Serial != pages[0].Serial || page.Sequence != uint32(i) {
+			t.Errorf("page %d: serial %x sequence %d", i, page.Serial, page.Sequence)
+		}
+	}
+
+	if NewOggTagger().Reset() {
+		t.Error("a tagger that saw no stream claims it can start over")
+	}
+}
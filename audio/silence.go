@@ -0,0 +1,300 @@
+package audio
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+/*
+Silence generates silent audio that matches the stream it has been shown.
+
+For MP3 this is a frame with the same header as the last one observed and
+an empty body, which decodes to silence for every layer. For Ogg/Vorbis a
+new logical stream is started that reuses the headers of the last stream
+observed, followed by audio packets with all floors marked unused.
+*/
+type Silence struct {
+	// The format of the stream, "MP3" or "OGG"
+	Format string
+	// The last MP3 frame header seen, valid if haveMP3 is set
+	mp3     MP3Header
+	haveMP3 bool
+	// The header pages of the last Ogg stream seen
+	headers oggHeaders
+	// The Vorbis stream we are generating, nil if we aren't
+	vorbis *vorbisSilence
+}
+
+/*
+Creates a new Silence for the format given, an empty format is treated as
+MP3.
+*/
+func NewSilence(format string) *Silence {
+	if format != "OGG" {
+		format = "MP3"
+	}
+	return &Silence{Format: format}
+}
+
+/*
+Looks at frame aligned data of the stream, which is used to decide what the
+silence should look like.
+*/
+func (self *Silence) Observe(data []byte) {
+	if self.Format != "OGG" {
+		if header, ok := ParseMP3Header(data); ok {
+			self.mp3, self.haveMP3 = header, true
+		}
+		return
+	}
+
+	for len(data) > 0 {
+		page, ok := ParseOggPage(data)
+		if !ok || len(data) < page.Size {
+			return
+		}
+		self.headers.observe(page, data[:page.Size])
+		data = data[page.Size:]
+	}
+}
+
+/*
+Returns silent frames that play for at least the duration given, together
+with their exact playing time. Nil is returned if we haven't seen enough
+of the stream yet to know what the silence should look like.
+
+Ogg silence is a logical stream of its own, the first call after creating
+the Silence or after calling Finish starts it.
+*/
+func (self *Silence) Generate(duration time.Duration) ([]byte, time.Duration) {
+	if duration <= 0 {
+		return nil, 0
+	}
+	if self.Format == "OGG" {
+		return self.generateVorbis(duration)
+	}
+	if !self.haveMP3 {
+		return nil, 0
+	}
+
+	header := self.mp3
+	// No padding and no CRC, this makes every frame the same
+	header.Raw[1] |= 0x01
+	header.Raw[2] &^= 0x02
+	header.Padding = false
+
+	frame := make([]byte, header.FrameSize())
+	copy(frame, header.Raw[:])
+
+	count := int((duration + header.Duration() - 1) / header.Duration())
+	data := make([]byte, 0, count*len(frame))
+	for i := 0; i < count; i++ {
+		data = append(data, frame...)
+	}
+	return data, time.Duration(count) * header.Duration()
+}
+
+/*
+Ends the silence, this returns the last page of the logical stream for
+Ogg and nil for MP3. The data returned should be sent before anything else
+following the silence.
+*/
+func (self *Silence) Finish() []byte {
+	if self.vorbis == nil {
+		return nil
+	}
+	data := self.vorbis.page(1, OggEOS)
+	self.vorbis = nil
+	return data
+}
+
+func (self *Silence) generateVorbis(duration time.Duration) ([]byte, time.Duration) {
+	var data []byte
+	if self.vorbis == nil {
+		self.vorbis = newVorbisSilence(self.headers.complete)
+		if self.vorbis == nil {
+			return nil, 0
+		}
+		data = self.vorbis.start()
+	}
+
+	stream := self.vorbis
+	packetTime := time.Duration(stream.samples) * time.Second /
+		time.Duration(stream.rate)
+
+	count := int((duration + packetTime - 1) / packetTime)
+	generated := time.Duration(count) * packetTime
+	for count > 0 {
+		// Every packet takes one lacing value, a page holds 255 of them
+		packets := count
+		if packets > 255 {
+			packets = 255
+		}
+		data = append(data, stream.page(packets, 0)...)
+		count -= packets
+	}
+	return data, generated
+}
+
+/*
+vorbisSilence is the state of a silent Vorbis logical stream.
+*/
+type vorbisSilence struct {
+	// The three header packets of the stream
+	identification, comment, setup []byte
+	// The silent audio packet
+	packet []byte
+	// Samples per channel each packet adds
+	samples int
+	// Sample rate of the stream
+	rate int
+	// Ogg page state
+	serial   uint32
+	sequence uint32
+	granule  int64
+}
+
+/*
+Prepares a silent stream based on the header pages of a Vorbis stream,
+nil is returned if they can't be used.
+*/
+func newVorbisSilence(headers []byte) *vorbisSilence {
+	packets := OggPackets(headers)
+	if len(packets) < 3 || len(packets[0]) < 30 ||
+		string(packets[0][:7]) != "\x01vorbis" {
+		return nil
+	}
+
+	identification := packets[0]
+	channels := int(identification[11])
+	rate := int(binary.LittleEndian.Uint32(identification[12:]))
+	blocksizes := identification[28]
+
+	modes := vorbisModes(packets[2])
+	if len(modes) == 0 || channels == 0 || rate == 0 {
+		return nil
+	}
+
+	// We always use mode 0, a block is half overlapped with the next
+	blocksize := 1 << (blocksizes & 0x0F)
+	if modes[0] {
+		blocksize = 1 << (blocksizes >> 4)
+	}
+
+	// An audio packet that is all zero bits uses mode 0 and marks the
+	// floor of every channel as unused, which means there is no residue
+	// to decode either. The size leaves room for the widest floor 0
+	// amplitude field on every channel.
+	packet := make([]byte, 2+channels*8)
+
+	return &vorbisSilence{
+		identification: identification,
+		comment:        packets[1],
+		setup:          packets[2],
+		packet:         packet,
+		samples:        blocksize / 2,
+		rate:           rate,
+		serial:         uint32(time.Now().UnixNano()),
+	}
+}
+
+/*
+Returns the header pages of the stream.
+*/
+func (self *vorbisSilence) start() []byte {
+	data := BuildOggPage(OggBOS, 0, self.serial, self.sequence,
+		[][]byte{self.identification})
+	self.sequence++
+	data = append(data, BuildOggPage(0, 0, self.serial, self.sequence,
+		[][]byte{self.comment, self.setup})...)
+	self.sequence++
+	return data
+}
+
+/*
+Returns a page with the amount of silent packets given.
+*/
+func (self *vorbisSilence) page(packets int, flags byte) []byte {
+	list := make([][]byte, packets)
+	for i := range list {
+		list[i] = self.packet
+	}
+	self.granule += int64(packets * self.samples)
+
+	data := BuildOggPage(flags, self.granule, self.serial, self.sequence, list)
+	self.sequence++
+	return data
+}
+
+/*
+Returns the block flag of each mode in a Vorbis setup header.
+
+The modes are the last thing in the setup header, but everything before
+them has to be decoded to find where they start. Instead we read them
+backwards from the end, each mode is 41 bits with 32 of them always zero,
+and look for a 6 bit mode count in front of them that matches. This is
+the same approach used by other software that only needs the modes.
+*/
+func vorbisModes(setup []byte) []bool {
+	reader := backwardBits{data: setup, position: len(setup) * 8}
+
+	// Find the framing bit that ends the header
+	for reader.position > 0 && reader.read(1) == 0 {
+	}
+	end := reader.position
+
+	// Garbage in front of the modes can look like a mode as well, so the
+	// last count that matched is used.
+	count, matched := 0, 0
+	for reader.position >= 41 && count < 64 {
+		mapping := reader.read(8)
+		transform := reader.read(16)
+		window := reader.read(16)
+		if mapping > 63 || transform != 0 || window != 0 {
+			break
+		}
+		reader.read(1)
+		count++
+		if reader.position >= 6 && reader.peek(6) == count-1 {
+			matched = count
+		}
+	}
+	if matched == 0 {
+		return nil
+	}
+	count = matched
+
+	modes := make([]bool, count)
+	reader.position = end
+	for i := count - 1; i >= 0; i-- {
+		reader.read(40)
+		modes[i] = reader.read(1) == 1
+	}
+	return modes
+}
+
+/*
+backwardBits reads a Vorbis bit stream from the end towards the start.
+Values are returned as if they had been read forwards.
+*/
+type backwardBits struct {
+	data     []byte
+	position int
+}
+
+func (self *backwardBits) read(n int) int {
+	value := 0
+	for i := 0; i < n && self.position > 0; i++ {
+		self.position--
+		bit := int(self.data[self.position/8]>>(self.position%8)) & 1
+		value = value<<1 | bit
+	}
+	return value
+}
+
+func (self *backwardBits) peek(n int) int {
+	position := self.position
+	value := self.read(n)
+	self.position = position
+	return value
+}
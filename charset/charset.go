@@ -0,0 +1,228 @@
+/*
+Package charset converts text sent by sources, such as their metadata, to
+UTF-8. Sources are notoriously bad at telling what encoding they use, so
+this guesses when what they claim doesn't work out.
+
+Nothing in here depends on the configuration, the server package passes
+in the charset a source gave and logs the errors returned.
+*/
+package charset
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+/*
+An encoding we try when the one a source gives us doesn't work out, along
+with the scripts text in it is expected to be written in and characters
+that are common in it.
+*/
+type guess struct {
+	Name    string
+	Scripts []*unicode.RangeTable
+	// Characters common in text of the encoding, used to pick between
+	// guesses that all decode to letters of the expected scripts
+	Common string
+}
+
+// Common characters by language, taken from the top of frequency lists.
+// They only have to set the right guess apart from text of another
+// encoding decoded into random characters, so they don't need to be long.
+const (
+	commonJapanese = "のにはをたがでてとしれさあるいうなかまこそんくすもらりっきけせつみめよわ" +
+		"ーントスルイクリラアレタドロ" +
+		"日一国人年大十二本中長出三同時事自行社見月分後前生五間上東者地合市業内" +
+		"相方四定今回新場金員九入立開手力学問高代明実円関子動京全目表戦通外最言" +
+		"現理体化田当八六主下意法不来作性的要用度強気小七成期公野取都和以機平山" +
+		"思家話世受多進正安記女北心界第百点教書先共名道所次水物私夜空愛恋君僕夢" +
+		"花光雨風星歌声色涙音春夏秋冬海"
+	commonKorean = "이다는의에가을하고지기를사서한리로대도자정나시어인수아일그해게구전보부" +
+		"상내거주만요라문장들우원제스소경여면러있것없랑너마음니까세오늘날때말생각" +
+		"더모두같잘알좋싶눈물바람꿈별밤길손노래처럼녕사랑해안난걸줘날봐네"
+	commonSimplified = "的一是不了人我在有他这中大来上个国到说们为子和你地出道也时年得就那要下" +
+		"以生会自着去之过家学对可她里后小么心多天而能好都然没日于起还发成事只作" +
+		"当想看文无开手十用主行方又如前所本见经头面公同三已老从动两长知民样现分" +
+		"将外但身些与高意进把法此实回二理美点月明其种声全工己话儿者向情部正名定" +
+		"女问力机给等几很业最间新什打便位因重被走电四第门相次东海口使西再平真听" +
+		"世气信北少关并内加化由却代入先山五太水万市眼体别处总才场书比九笑性通目" +
+		"爱歌曲梦风花雪夜光乐恋"
+	commonTraditional = "的一是不了人我在有他這中大來上個國到說們為子和你地出道也時年得就那要下" +
+		"以生會自著去之過家學對可她裡後小麼心多天而能好都然沒日於起還發成事只作" +
+		"當想看文無開手十用主行方又如前所本見經頭面公同三已老從動兩長知民樣現分" +
+		"將外但身些與高意進把法此實回二理美點月明其種聲全工己話兒者向情部正名定" +
+		"女問力機給等幾很業最間新什打便位因重被走電四第門相次東海口使西再平真聽" +
+		"世氣信北少關並內加化由卻代入先山五太水萬市眼體別處總才場書比九笑性通目" +
+		"愛歌曲夢風花雪夜光樂戀"
+)
+
+/*
+The encodings tried, in order, when the text isn't valid UTF-8 and doesn't
+decode cleanly in the charset given by the source. Single byte encodings
+other than latin1 can't be told apart by looking at the text alone, so they
+are only used when a source asks for them.
+*/
+var guesses = []guess{
+	{"windows-1252", []*unicode.RangeTable{unicode.Latin}, ""},
+	{"shift_jis", []*unicode.RangeTable{unicode.Hiragana, unicode.Katakana, unicode.Han},
+		commonJapanese},
+	{"euc-jp", []*unicode.RangeTable{unicode.Hiragana, unicode.Katakana, unicode.Han},
+		commonJapanese},
+	{"euc-kr", []*unicode.RangeTable{unicode.Hangul, unicode.Han}, commonKorean},
+	{"gbk", []*unicode.RangeTable{unicode.Han}, commonSimplified},
+	{"big5", []*unicode.RangeTable{unicode.Han}, commonTraditional},
+}
+
+/*
+Converts text sent by a source to UTF-8. name is the charset the source says
+it used, "" if it didn't say.
+
+Plenty of encoders send UTF-8 while claiming latin1 or the other way
+around, so text that is valid UTF-8 is used as it is. Otherwise the text
+is decoded with the charset given and each of the guesses, and the one
+that results in the most letters of the scripts expected for it wins, see
+scriptScore. Several of the CJK encodings share byte ranges and often all
+decode to nothing but Han characters, those ties go to the guess with the
+most characters common in its language. The charset given wins any ties
+left.
+
+The text returned is always usable, an error only tells what went wrong
+on the way, such as an unknown charset.
+*/
+func Decode(name string, text string) (string, error) {
+	if utf8.ValidString(text) {
+		return text, nil
+	}
+
+	var err error
+	candidates := guesses
+	if name != "" {
+		enc, encErr := htmlindex.Get(name)
+		if encErr != nil {
+			err = fmt.Errorf("unknown charset '%s'", name)
+		} else if name, _ = htmlindex.Name(enc); name == "utf-8" {
+			// The source lied or sent garbage, there's nothing to honour
+		} else {
+			given := guess{Name: name}
+			for _, other := range guesses {
+				if other.Name == name {
+					given.Common = other.Common
+				}
+			}
+			candidates = append([]guess{given}, guesses...)
+		}
+	}
+
+	best, bestScore, bestCommon, bestMatching := "", -1.0, 0, 0
+	for _, candidate := range candidates {
+		decoded, ok := decode(candidate.Name, text)
+		if !ok {
+			continue
+		}
+		scripts := candidate.Scripts
+		if scripts == nil {
+			// The charset given by the source, we take its word on what
+			// scripts it contains.
+			scripts = []*unicode.RangeTable{unicode.L}
+		}
+		score, matching := scriptScore(decoded, scripts)
+		common := commonCount(decoded, candidate.Common)
+		if score > bestScore || score == bestScore && (common > bestCommon ||
+			common == bestCommon && matching > bestMatching) {
+			best, bestScore, bestCommon, bestMatching = decoded, score, common, matching
+		}
+	}
+
+	if bestScore < 0 {
+		// Nothing decoded cleanly, keep what we can of it
+		return strings.ToValidUTF8(text, string(utf8.RuneError)),
+			fmt.Errorf("undecodable text %q", text)
+	}
+	return best, err
+}
+
+/*
+Decodes the text from the encoding named. The second return value is false
+if the text isn't valid in that encoding, or decodes to control characters
+which no sane metadata contains.
+*/
+func decode(name string, text string) (string, bool) {
+	enc, err := htmlindex.Get(name)
+	if err != nil {
+		return "", false
+	}
+	decoded, err := enc.NewDecoder().String(text)
+	if err != nil {
+		return "", false
+	}
+	for _, r := range decoded {
+		if r == utf8.RuneError || unicode.Is(unicode.Cc, r) {
+			return "", false
+		}
+	}
+	return decoded, true
+}
+
+/*
+Returns the fraction of non-ASCII letters in the text that look like they
+belong there, 1 if there are no such letters at all, and how many of them
+do. A letter belongs if it is of one of the scripts given and next to
+another letter of those scripts, or a word on its own between spaces and
+plain punctuation. Text decoded with the wrong encoding tends to end up as
+odd letters between symbols or in the middle of words of another script.
+*/
+func scriptScore(text string, scripts []*unicode.RangeTable) (float64, int) {
+	runes := []rune(text)
+	fits := func(i int) bool {
+		return i >= 0 && i < len(runes) && unicode.IsOneOf(scripts, runes[i]) &&
+			!isHalfwidthKana(runes[i])
+	}
+	// Single letter words are common in CJK text
+	apart := func(i int) bool {
+		return i < 0 || i >= len(runes) ||
+			runes[i] < utf8.RuneSelf && !unicode.IsLetter(runes[i])
+	}
+
+	var letters, matching int
+	for i, r := range runes {
+		if r < utf8.RuneSelf || !unicode.IsLetter(r) {
+			continue
+		}
+		letters++
+		if fits(i) && (fits(i-1) || fits(i+1) || apart(i-1) && apart(i+1)) {
+			matching++
+		}
+	}
+	if letters == 0 {
+		return 1, 0
+	}
+	return float64(matching) / float64(letters), matching
+}
+
+/*
+Returns how many characters of the text are among the common ones given.
+*/
+func commonCount(text string, common string) int {
+	if common == "" {
+		return 0
+	}
+	var count int
+	for _, r := range text {
+		if r >= utf8.RuneSelf && strings.ContainsRune(common, r) {
+			count++
+		}
+	}
+	return count
+}
+
+/*
+Returns true for halfwidth katakana, which is what most other encodings end
+up as when read as Shift_JIS and hardly ever used for real.
+*/
+func isHalfwidthKana(r rune) bool {
+	return r >= 0xFF61 && r <= 0xFF9F
+}
@@ -0,0 +1,75 @@
+package charset
+
+import (
+	"testing"
+
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+func encode(t *testing.T, name string, text string) string {
+	enc, err := htmlindex.Get(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := enc.NewEncoder().String(text)
+	if err != nil {
+		t.Fatalf("encoding %q as %s: %s", text, name, err)
+	}
+	return encoded
+}
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		name     string
+		charset  string
+		encoding string
+		text     string
+	}{
+		// UTF-8 is used as it is, whatever the source claims
+		{"utf-8 sent as latin1", "iso-8859-1", "", "Björk - Jóga"},
+		{"utf-8 sent as shift_jis", "shift_jis", "", "宇多田ヒカル - First Love"},
+		{"latin1", "", "windows-1252", "Sigur Rós - Hoppípolla"},
+		{"latin1 sent as latin1", "iso-8859-1", "windows-1252", "Mötley Crüe - Kickstart My Heart"},
+		{"shift_jis sent as latin1", "iso-8859-1", "shift_jis", "こんにちは世界"},
+		{"shift_jis", "", "shift_jis", "宇多田ヒカル - 花束を君に"},
+		{"euc-jp", "", "euc-jp", "ゆらゆら帝国 - 空洞です"},
+		{"euc-kr", "", "euc-kr", "안녕하세요"},
+		{"euc-kr with latin", "", "euc-kr", "아이유 - 좋은 날"},
+		{"gbk", "", "gbk", "你好世界"},
+		{"gbk song", "", "gbk", "王菲 - 我愿意"},
+		{"big5", "", "big5", "中文歌曲"},
+		{"big5 song", "", "big5", "周杰倫 - 說好的幸福呢"},
+		{"windows-1251 given", "windows-1251", "windows-1251", "Кино - Группа крови"},
+		{"koi8-r given", "koi8-r", "koi8-r", "Кино - Звезда по имени Солнце"},
+	}
+
+	for _, test := range tests {
+		meta := test.text
+		if test.encoding != "" {
+			meta = encode(t, test.encoding, test.text)
+		}
+		decoded, err := Decode(test.charset, meta)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+		}
+		if decoded != test.text {
+			t.Errorf("%s: got %q, want %q", test.name, decoded, test.text)
+		}
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	meta := encode(t, "windows-1252", "Sigur Rós")
+	decoded, err := Decode("no-such-charset", meta)
+	if err == nil {
+		t.Error("unknown charset: expected an error")
+	}
+	if decoded != "Sigur Rós" {
+		t.Errorf("unknown charset: got %q, want the guess", decoded)
+	}
+
+	// Control characters are never valid metadata, whatever the encoding
+	if decoded, err = Decode("", "\x01\x02\xff"); err == nil {
+		t.Errorf("undecodable: expected an error, got %q", decoded)
+	}
+}
@@ -3,6 +3,10 @@ package config
 import (
 	"flag"
 	"github.com/kylelemons/go-gypsy/yaml"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -17,11 +21,235 @@ var ServerAddress = ":"
 var CpuProfile string
 var MemoryProfile string
 
+// Silence detection, a zero SilenceDuration disables the detection.
+var SilenceThreshold float64 = -50
+var SilenceDuration time.Duration
+var SilenceDemote bool
+
+// Silence filler, a zero SilenceFill disables the filler.
+var SilenceFill time.Duration
+var SilenceLinger time.Duration
+
+// Fallback directories or playlists by mount name.
+var Fallbacks = map[string]string{}
+
+// Mounts whose audio is carried by a mount without a live source, by
+// mount name.
+var FallbackMounts = map[string]string{}
+
+// Jingle settings by mount name.
+var Jingles = map[string]Jingle{}
+
+/*
+Jingle contains the settings for the clips played on a mount between
+clients and at fixed intervals.
+*/
+type Jingle struct {
+	// A file, directory or playlist of clips
+	Path string
+	// How often a clip is played while a client is live, zero if only
+	// handovers get one
+	Interval time.Duration
+}
+
+// Source queue priorities by permission name and by user name, sources
+// with at least PreemptPriority take over from a lower live source. A zero
+// PreemptPriority disables preempting.
+var PermissionPriorities = map[string]int{}
+var UserPriorities = map[string]int{}
+var PreemptPriority int
+
+// Show schedule by mount name. ScheduleDemote moves the live source back
+// into the queue when its slot ends, ScheduleReject refuses sources that
+// connect during the slot of someone else instead of queueing them last.
+var Schedule = map[string][]Slot{}
+var ScheduleDemote bool
+var ScheduleReject bool
+
+/*
+Slot is a recurring time window in which a user owns a mount.
+*/
+type Slot struct {
+	// The user owning the mount
+	User string
+	// The days of the week the slot is on
+	Days [7]bool
+	// Start and end of the slot as time since midnight, a slot ending
+	// before it starts runs past midnight
+	Start, End time.Duration
+}
+
+/*
+Returns true if the time given falls inside the slot, in the local time
+zone.
+*/
+func (self Slot) Contains(t time.Time) bool {
+	t = t.Local()
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	offset := t.Sub(midnight)
+	day := t.Weekday()
+
+	if self.Start <= self.End {
+		return self.Days[day] && offset >= self.Start && offset < self.End
+	}
+	// Runs past midnight, the part after midnight belongs to the day
+	// before.
+	yesterday := (day + 6) % 7
+	return self.Days[day] && offset >= self.Start ||
+		self.Days[yesterday] && offset < self.End
+}
+
+// How long the slot of a live source that lost its connection is held for
+// it, zero disables holding the slot.
+var ReconnectGrace time.Duration
+
+// Limits on how long sources may stay live or wait in the queue. Mount
+// limits override the defaults and user limits override both.
+var DefaultLimits Limits
+var MountLimits = map[string]Limits{}
+var UserLimits = map[string]Limits{}
+
+/*
+Limits contains the time limits of sources, a zero duration means there is
+no limit. In MountLimits and UserLimits a negative duration means the
+setting is inherited.
+*/
+type Limits struct {
+	// How long a source may stay live while others are waiting
+	Live time.Duration
+	// How long before the live limit a warning is given
+	Warning time.Duration
+	// How long a source may wait in the queue
+	Wait time.Duration
+}
+
+/*
+Returns the limits that apply to a user on a mount.
+*/
+func LimitsFor(mount string, user string) Limits {
+	limits := DefaultLimits
+	if override, ok := MountLimits[mount]; ok {
+		limits = limits.override(override)
+	}
+	if override, ok := UserLimits[strings.ToLower(user)]; ok {
+		limits = limits.override(override)
+	}
+	return limits
+}
+
+/*
+Returns the limits with the settings of override that aren't inherited.
+*/
+func (self Limits) override(override Limits) Limits {
+	if override.Live >= 0 {
+		self.Live = override.Live
+	}
+	if override.Warning >= 0 {
+		self.Warning = override.Warning
+	}
+	if override.Wait >= 0 {
+		self.Wait = override.Wait
+	}
+	return self
+}
+
+// How many metadata changes are kept for each mount, and the directory
+// they are persisted to. An empty HistoryPath keeps them in memory only.
+var HistoryLength = 100
+var HistoryPath string
+
+// How long metadata of sources that haven't connected yet is kept.
+var MetadataTTL = time.Second * 30
+
+// How much later metadata is sent than the audio it belongs to, for mounts
+// without an offset of their own.
+var DefaultMetadataOffset time.Duration
+
+// The template structured metadata is rendered with before it is sent.
+var MetadataTemplate = "{artist} - {title}"
+
+// How often a single source and a single mount may update their metadata.
+var ClientMetadataLimit = RateLimit{Interval: time.Second, Burst: 5}
+var MountMetadataLimit = RateLimit{Interval: time.Second / 2, Burst: 10}
+
+/*
+RateLimit is a token bucket, it holds up to Burst updates and gains one
+every Interval. A zero Interval means there is no limit.
+*/
+type RateLimit struct {
+	Interval time.Duration
+	Burst    int
+}
+
+// Metadata rewriting rules by mount name, the rules under "default" apply
+// to mounts without rules of their own.
+var MetadataRules = map[string][]MetadataRule{}
+
+/*
+MetadataRule is a single step of the metadata rewriting pipeline. Only the
+fields of its Kind are set.
+*/
+type MetadataRule struct {
+	// One of "replace", "template", "limit", "block" or "dedup"
+	Kind string
+	// The expression to replace or block
+	Pattern *regexp.Regexp
+	// The replacement for "replace", the template for "template"
+	Text string
+	// The maximum length in characters for "limit"
+	Limit int
+}
+
+// The directory now playing files are written to, "" if none are.
+var NowPlayingPath string
+
+// The URLs now playing updates are posted to, and how hard we try.
+var Webhooks []string
+var WebhookTimeout = time.Second * 5
+var WebhookRetries = 3
+
+// Metadata inputs by mount name.
+var MetadataInputs = map[string]MetadataInput{}
+
+/*
+MetadataInput contains the places metadata for the live source of a mount
+is read from, besides the source itself.
+*/
+type MetadataInput struct {
+	// A file of which every new line is metadata, "" if none
+	File string
+	// A Unix socket that takes metadata a line at a time, "" if none
+	Socket string
+	// The charset of the metadata, "" to guess
+	Charset string
+}
+
+// Broadcast delay settings by mount name.
+var Delays = map[string]Delay{}
+
+/*
+Delay contains the settings for holding back live audio on a mount before
+it is sent upstream.
+*/
+type Delay struct {
+	// How long live audio is held back
+	Duration time.Duration
+	// What is played while the delay builds back up after the buffer is
+	// dumped, "fallback" or "silence"
+	Dump string
+	// How much the delay grows back at a time after a dump
+	Refill time.Duration
+}
+
 func init() {
 	flag.StringVar(&configFile, "c", "proxy.yaml", "Configuration file path.")
 	flag.BoolVar(&Authentication, "auth", true, "False if authentication should be disabled")
 	flag.StringVar(&CpuProfile, "cpuprofile", "", "Write CPU profile to file")
 	flag.StringVar(&MemoryProfile, "memoryprofile", "", "Write Memory profile to file")
+	// Tests bring their own flags and set up whatever configuration they need
+	if strings.HasSuffix(os.Args[0], ".test") {
+		return
+	}
 	flag.Parse()
 	Config = yaml.ConfigFile(configFile)
 
@@ -41,6 +269,85 @@ func init() {
 			}
 		}
 	}
+
+	loadMounts()
+	loadSilence()
+	loadFallbacks()
+	loadFallbackMounts()
+	loadJingles()
+	loadDelays()
+	loadPriorities()
+	loadSchedule()
+	loadReconnect()
+	loadLimits()
+	loadHistory()
+	loadMetadata()
+	loadMetadataRules()
+	loadMetadataInputs()
+	loadNowPlaying()
+}
+
+/*
+Reads the optional "silence" section of the configuration. It looks like
+
+	silence:
+	    threshold: -50
+	    duration: 30s
+	    demote: true
+	    fill: 2s
+	    linger: 30s
+
+threshold is in dBFS, duration is how long a live source may stay below
+the threshold before it is considered dead air and demote indicates if
+such a source should be moved back into the queue.
+
+fill is how long a mount may go without sending anything upstream before
+silence is generated to keep the connection alive, and linger is how long
+a mount without any clients keeps doing so before it is collected.
+*/
+func loadSilence() {
+	node, err := yaml.Child(Config.Root, "silence")
+	if err != nil {
+		return
+	}
+
+	m, ok := node.(yaml.Map)
+	if !ok {
+		panic("Silence configuration isn't a mapping.")
+	}
+
+	for key, value := range m {
+		scalar, ok := value.(yaml.Scalar)
+		if !ok {
+			continue
+		}
+		switch key {
+		case "threshold":
+			threshold, err := strconv.ParseFloat(string(scalar), 64)
+			if err != nil {
+				panic("Silence threshold isn't a number.")
+			}
+			SilenceThreshold = threshold
+		case "duration":
+			duration, err := time.ParseDuration(string(scalar))
+			if err != nil {
+				panic("Silence duration isn't a valid duration.")
+			}
+			SilenceDuration = duration
+		case "demote":
+			SilenceDemote = string(scalar) == "true"
+		case "fill", "linger":
+			duration, err := time.ParseDuration(string(scalar))
+			if err != nil {
+				panic("Silence " + key + " isn't a valid duration.")
+			}
+			if key == "fill" {
+				SilenceFill = duration
+			} else {
+				SilenceLinger = duration
+			}
+		}
+	}
 }
 
 func CreateShoutMap() map[string]string {
@@ -129,3 +436,783 @@ func CreateDatabaseDSN() string {
 	}
 	return DBN
 }
+
+/*
+Reads the optional "fallback" section of the configuration. It maps mount
+names to a directory or playlist file to play when no source is live.
+
+	fallback:
+	    /gopher.mp3: /srv/music/fallback
+	    /gopher.ogg: /srv/music/fallback.m3u
+*/
+func loadFallbacks() {
+	node, err := yaml.Child(Config.Root, "fallback")
+	if err != nil {
+		return
+	}
+
+	m, ok := node.(yaml.Map)
+	if !ok {
+		panic("Fallback configuration isn't a mapping.")
+	}
+
+	for mount, value := range m {
+		if scalar, ok := value.(yaml.Scalar); ok {
+			Fallbacks[configMount(mount)] = string(scalar)
+		}
+	}
+}
+
+/*
+Reads the optional "fallback_mounts" section of the configuration. It maps
+mount names to the mount they fall back to, like the fallback-mount
+setting of icecast.
+
+	fallback_mounts:
+	    /main.mp3: /backup.mp3
+	    /backup.mp3: /autodj.mp3
+
+A mount without a live source sends the audio of the first mount down the
+chain that has one or is playing its fallback, and switches back as soon as
+its own source returns. Mounts in a chain have to use the same format.
+*/
+func loadFallbackMounts() {
+	node, err := yaml.Child(Config.Root, "fallback_mounts")
+	if err != nil {
+		return
+	}
+
+	m, ok := node.(yaml.Map)
+	if !ok {
+		panic("Fallback mount configuration isn't a mapping.")
+	}
+
+	for mount, value := range m {
+		if scalar, ok := value.(yaml.Scalar); ok {
+			FallbackMounts[configMount(mount)] = configMount(string(scalar))
+		}
+	}
+}
+
+/*
+Reads the optional "jingles" section of the configuration. It maps mount
+names to the clips to play whenever a new client goes live, and optionally
+at a fixed interval as well.
+
+	jingles:
+	    /gopher.mp3:
+	        path: /srv/jingles/station-id.mp3
+	        interval: 30m
+*/
+func loadJingles() {
+	node, err := yaml.Child(Config.Root, "jingles")
+	if err != nil {
+		return
+	}
+
+	m, ok := node.(yaml.Map)
+	if !ok {
+		panic("Jingle configuration isn't a mapping.")
+	}
+
+	for mount, value := range m {
+		settings, ok := value.(yaml.Map)
+		if !ok {
+			panic("Jingle configuration of " + mount + " isn't a mapping.")
+		}
+
+		jingle := Jingle{}
+		if scalar, ok := settings["path"].(yaml.Scalar); ok {
+			jingle.Path = string(scalar)
+		} else {
+			panic("Jingle configuration of " + mount + " has no path.")
+		}
+		if scalar, ok := settings["interval"].(yaml.Scalar); ok {
+			interval, err := time.ParseDuration(string(scalar))
+			if err != nil {
+				panic("Jingle interval of " + mount + " isn't a valid duration.")
+			}
+			jingle.Interval = interval
+		}
+		Jingles[configMount(mount)] = jingle
+	}
+}
+
+/*
+Reads the optional "delay" section of the configuration. It maps mount
+names to a broadcast delay, live audio is held back for the duration given
+so that it can be dumped before it goes out.
+
+	delay:
+	    /gopher.mp3:
+	        duration: 10s
+	        dump: fallback
+	        refill: 2s
+
+Dumping the buffer brings the live audio back right away, without any
+delay. The delay then builds back up a refill (2 seconds by default) at a
+time, by holding back the live audio while something else covers for it.
+dump decides what that is, "fallback" plays the fallback of the mount if it
+has one and "silence" (the default) sends silence.
+*/
+func loadDelays() {
+	node, err := yaml.Child(Config.Root, "delay")
+	if err != nil {
+		return
+	}
+
+	m, ok := node.(yaml.Map)
+	if !ok {
+		panic("Delay configuration isn't a mapping.")
+	}
+
+	for mount, value := range m {
+		settings, ok := value.(yaml.Map)
+		if !ok {
+			panic("Delay configuration of " + mount + " isn't a mapping.")
+		}
+
+		delay := Delay{Dump: "silence", Refill: time.Second * 2}
+		if scalar, ok := settings["duration"].(yaml.Scalar); ok {
+			duration, err := time.ParseDuration(string(scalar))
+			if err != nil || duration <= 0 {
+				panic("Delay duration of " + mount + " isn't a valid duration.")
+			}
+			delay.Duration = duration
+		} else {
+			panic("Delay configuration of " + mount + " has no duration.")
+		}
+		if scalar, ok := settings["dump"].(yaml.Scalar); ok {
+			delay.Dump = string(scalar)
+			if delay.Dump != "fallback" && delay.Dump != "silence" {
+				panic("Delay dump of " + mount + " isn't fallback or silence.")
+			}
+		}
+		if scalar, ok := settings["refill"].(yaml.Scalar); ok {
+			refill, err := time.ParseDuration(string(scalar))
+			if err != nil || refill <= 0 {
+				panic("Delay refill of " + mount + " isn't a valid duration.")
+			}
+			delay.Refill = refill
+		}
+		Delays[configMount(mount)] = delay
+	}
+}
+
+/*
+Reads the optional "priority" section of the configuration. Sources
+waiting in the queue of a mount go live in order of priority, the ones
+with the same priority in the order they connected.
+
+	priority:
+	    permissions:
+	        source: 0
+	        admin: 10
+	    users:
+	        vin: 20
+	    preempt: 10
+
+A user without its own priority gets the one of its permission level,
+everyone gets zero by default. A source with a priority of at least
+preempt goes live right away if the live source has a lower priority.
+*/
+func loadPriorities() {
+	node, err := yaml.Child(Config.Root, "priority")
+	if err != nil {
+		return
+	}
+
+	m, ok := node.(yaml.Map)
+	if !ok {
+		panic("Priority configuration isn't a mapping.")
+	}
+
+	if scalar, ok := m["preempt"].(yaml.Scalar); ok {
+		preempt, err := strconv.Atoi(string(scalar))
+		if err != nil {
+			panic("Preempt priority isn't a number.")
+		}
+		PreemptPriority = preempt
+	}
+
+	loadPriorityMap(m, "permissions", PermissionPriorities)
+	loadPriorityMap(m, "users", UserPriorities)
+}
+
+func loadPriorityMap(m yaml.Map, key string, priorities map[string]int) {
+	node, ok := m[key]
+	if !ok {
+		return
+	}
+
+	values, ok := node.(yaml.Map)
+	if !ok {
+		panic("Priority " + key + " isn't a mapping.")
+	}
+
+	for name, value := range values {
+		scalar, ok := value.(yaml.Scalar)
+		if !ok {
+			continue
+		}
+		priority, err := strconv.Atoi(string(scalar))
+		if err != nil {
+			panic("Priority of " + name + " isn't a number.")
+		}
+		priorities[strings.ToLower(name)] = priority
+	}
+}
+
+// Day names accepted in the schedule, by their first three letters.
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday,
+	"wed": time.Wednesday, "thu": time.Thursday, "fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+/*
+Reads the optional "schedule" section of the configuration. It lists the
+time slots in which users own a mount, in the local time zone.
+
+	schedule:
+	    demote: true
+	    offschedule: queue
+	    slots:
+	        /gopher.mp3:
+	            - user: vin
+	              days: mon wed fri
+	              start: "20:00"
+	              end: "22:00"
+
+days is optional and defaults to every day. The owner of a slot is made
+live when it starts, and when demote is set moved back into the queue
+when it ends. offschedule decides what happens to other sources that
+connect during a slot, "queue" (the default) puts them behind everyone
+else and "reject" refuses them.
+*/
+func loadSchedule() {
+	node, err := yaml.Child(Config.Root, "schedule")
+	if err != nil {
+		return
+	}
+
+	m, ok := node.(yaml.Map)
+	if !ok {
+		panic("Schedule configuration isn't a mapping.")
+	}
+
+	if scalar, ok := m["demote"].(yaml.Scalar); ok {
+		demote, err := strconv.ParseBool(string(scalar))
+		if err != nil {
+			panic("Schedule demote isn't a boolean.")
+		}
+		ScheduleDemote = demote
+	}
+	if scalar, ok := m["offschedule"].(yaml.Scalar); ok {
+		switch string(scalar) {
+		case "queue":
+		case "reject":
+			ScheduleReject = true
+		default:
+			panic("Schedule offschedule isn't queue or reject.")
+		}
+	}
+
+	slots, ok := m["slots"].(yaml.Map)
+	if !ok {
+		panic("Schedule configuration has no slots mapping.")
+	}
+
+	for mount, value := range slots {
+		mount = configMount(mount)
+		list, ok := value.(yaml.List)
+		if !ok {
+			panic("Schedule of " + mount + " isn't a list.")
+		}
+		for _, item := range list {
+			settings, ok := item.(yaml.Map)
+			if !ok {
+				panic("Schedule slot of " + mount + " isn't a mapping.")
+			}
+			Schedule[mount] = append(Schedule[mount], parseSlot(mount, settings))
+		}
+	}
+}
+
+func parseSlot(mount string, settings yaml.Map) Slot {
+	slot := Slot{}
+
+	user, ok := settings["user"].(yaml.Scalar)
+	if !ok {
+		panic("Schedule slot of " + mount + " has no user.")
+	}
+	slot.User = string(user)
+
+	if days, ok := settings["days"].(yaml.Scalar); ok {
+		for _, name := range strings.Fields(strings.ToLower(string(days))) {
+			if len(name) < 3 {
+				panic("Schedule day " + name + " of " + mount + " isn't a day.")
+			}
+			day, ok := weekdays[name[:3]]
+			if !ok {
+				panic("Schedule day " + name + " of " + mount + " isn't a day.")
+			}
+			slot.Days[day] = true
+		}
+	} else {
+		for day := range slot.Days {
+			slot.Days[day] = true
+		}
+	}
+
+	slot.Start = parseClock(mount, settings, "start")
+	slot.End = parseClock(mount, settings, "end")
+	return slot
+}
+
+/*
+Parses a time of day in the HH:MM format into the time since midnight.
+*/
+func parseClock(mount string, settings yaml.Map, key string) time.Duration {
+	scalar, ok := settings[key].(yaml.Scalar)
+	if !ok {
+		panic("Schedule slot of " + mount + " has no " + key + ".")
+	}
+	clock, err := time.Parse("15:04", strings.Trim(string(scalar), `"'`))
+	if err != nil {
+		panic("Schedule " + key + " of " + mount + " isn't a valid time.")
+	}
+	return time.Duration(clock.Hour())*time.Hour +
+		time.Duration(clock.Minute())*time.Minute
+}
+
+/*
+Reads the optional "reconnect" section of the configuration.
+
+	reconnect:
+	    grace: 10s
+
+grace is how long the slot of a live source that lost its connection is
+kept free for it, the fallback or silence is sent in the meantime. The
+source goes live again right away if it reconnects in time.
+*/
+func loadReconnect() {
+	node, err := yaml.Child(Config.Root, "reconnect")
+	if err != nil {
+		return
+	}
+
+	m, ok := node.(yaml.Map)
+	if !ok {
+		panic("Reconnect configuration isn't a mapping.")
+	}
+
+	if scalar, ok := m["grace"].(yaml.Scalar); ok {
+		grace, err := time.ParseDuration(string(scalar))
+		if err != nil {
+			panic("Reconnect grace isn't a valid duration.")
+		}
+		ReconnectGrace = grace
+	}
+}
+
+/*
+Reads the optional "limits" section of the configuration.
+
+	limits:
+	    live: 2h
+	    warning: 5m
+	    wait: 30m
+	    mounts:
+	        /gopher.mp3:
+	            live: 3h
+	    users:
+	        vin:
+	            live: 0s
+
+live is how long a source may stay live before the next one in the queue
+takes over, a warning is given the duration of warning before that. wait
+is how long a source may wait in the queue before it is disconnected. The
+limits of a mount replace the defaults, the limits of a user replace both.
+*/
+func loadLimits() {
+	node, err := yaml.Child(Config.Root, "limits")
+	if err != nil {
+		return
+	}
+
+	m, ok := node.(yaml.Map)
+	if !ok {
+		panic("Limits configuration isn't a mapping.")
+	}
+
+	DefaultLimits = parseLimits("limits", m, Limits{})
+
+	for key, target := range map[string]map[string]Limits{
+		"mounts": MountLimits, "users": UserLimits} {
+		node, ok := m[key]
+		if !ok {
+			continue
+		}
+		entries, ok := node.(yaml.Map)
+		if !ok {
+			panic("Limits " + key + " isn't a mapping.")
+		}
+		for name, value := range entries {
+			settings, ok := value.(yaml.Map)
+			if !ok {
+				panic("Limits of " + name + " isn't a mapping.")
+			}
+			if key == "users" {
+				name = strings.ToLower(name)
+			} else {
+				name = configMount(name)
+			}
+			target[name] = parseLimits(name, settings, Limits{-1, -1, -1})
+		}
+	}
+}
+
+func parseLimits(name string, settings yaml.Map, limits Limits) Limits {
+	for key, field := range map[string]*time.Duration{"live": &limits.Live,
+		"warning": &limits.Warning, "wait": &limits.Wait} {
+		scalar, ok := settings[key].(yaml.Scalar)
+		if !ok {
+			continue
+		}
+		duration, err := time.ParseDuration(string(scalar))
+		if err != nil || duration < 0 {
+			panic("Limit " + key + " of " + name + " isn't a valid duration.")
+		}
+		*field = duration
+	}
+	return limits
+}
+
+/*
+Reads the optional "history" section of the configuration.
+
+	history:
+	    length: 1000
+	    path: /var/lib/icecast-proxy/history
+
+length is how many metadata changes are kept for each mount, 100 by
+default. When path is set the history of every mount is kept in a file in
+that directory, so it survives a restart.
+*/
+func loadHistory() {
+	node, err := yaml.Child(Config.Root, "history")
+	if err != nil {
+		return
+	}
+
+	m, ok := node.(yaml.Map)
+	if !ok {
+		panic("History configuration isn't a mapping.")
+	}
+
+	if scalar, ok := m["length"].(yaml.Scalar); ok {
+		length, err := strconv.Atoi(string(scalar))
+		if err != nil || length <= 0 {
+			panic("History length isn't a valid number.")
+		}
+		HistoryLength = length
+	}
+	if scalar, ok := m["path"].(yaml.Scalar); ok {
+		HistoryPath = string(scalar)
+	}
+}
+
+/*
+Reads the optional "metadata" section of the configuration.
+
+	metadata:
+	    ttl: 1m
+	    offset: 500ms
+	    template: "{artist} - {title} [{album}]"
+
+ttl is how long metadata is kept for a source that sent it before
+connecting, 30 seconds by default. Sources sending metadata first is
+common, since most of them send it right after connecting.
+
+Metadata is sent upstream along with the audio that was received before
+it. offset moves it to make up for latency elsewhere, such as the buffer of
+the encoder. A positive offset sends metadata later, a negative one earlier
+as far as the delay buffer of the mount allows.
+
+template is what metadata sent with separate fields turns into, "{artist}
+- {title}" by default. It can use {artist}, {title}, {album} and
+{duration}.
+
+rate_limit limits how often each source and each mount may update their
+metadata. A source may send burst updates at once, after which it gets one
+more every interval, updates sent faster than that are held back and only
+the latest of them is used. Sources default to one update a second with a
+burst of 5, mounts to two a second with a burst of 10. An interval of 0
+disables the limit.
+
+	metadata:
+	    rate_limit:
+	        client: 1s
+	        client_burst: 5
+	        mount: 500ms
+	        mount_burst: 10
+*/
+func loadMetadata() {
+	node, err := yaml.Child(Config.Root, "metadata")
+	if err != nil {
+		return
+	}
+
+	m, ok := node.(yaml.Map)
+	if !ok {
+		panic("Metadata configuration isn't a mapping.")
+	}
+
+	if scalar, ok := m["ttl"].(yaml.Scalar); ok {
+		ttl, err := time.ParseDuration(string(scalar))
+		if err != nil || ttl <= 0 {
+			panic("Metadata ttl isn't a valid duration.")
+		}
+		MetadataTTL = ttl
+	}
+	if scalar, ok := m["offset"].(yaml.Scalar); ok {
+		offset, err := time.ParseDuration(string(scalar))
+		if err != nil {
+			panic("Metadata offset isn't a valid duration.")
+		}
+		DefaultMetadataOffset = offset
+	}
+	if scalar, ok := m["template"].(yaml.Scalar); ok {
+		MetadataTemplate = strings.Trim(string(scalar), `"'`)
+	}
+	if limits, ok := m["rate_limit"].(yaml.Map); ok {
+		ClientMetadataLimit = parseRateLimit(limits, "client", ClientMetadataLimit)
+		MountMetadataLimit = parseRateLimit(limits, "mount", MountMetadataLimit)
+	}
+}
+
+/*
+Reads the interval and burst of a rate limit from the keys given and
+key_burst, keeping those of the limit given that aren't set.
+*/
+func parseRateLimit(m yaml.Map, key string, limit RateLimit) RateLimit {
+	if scalar, ok := m[key].(yaml.Scalar); ok {
+		interval, err := time.ParseDuration(string(scalar))
+		if err != nil || interval < 0 {
+			panic("Metadata rate limit " + key + " isn't a valid duration.")
+		}
+		limit.Interval = interval
+	}
+	if scalar, ok := m[key+"_burst"].(yaml.Scalar); ok {
+		burst, err := strconv.Atoi(string(scalar))
+		if err != nil || burst <= 0 {
+			panic("Metadata rate limit " + key + "_burst isn't a valid number.")
+		}
+		limit.Burst = burst
+	}
+	return limit
+}
+
+/*
+Reads the optional "metadata_rules" section of the configuration. It maps
+mount names to a list of rules that are applied in order to metadata sent
+by sources.
+
+	metadata_rules:
+	    default:
+	        - block: (?i)casino|viagra
+	        - dedup: true
+	    /gopher.mp3:
+	        - replace: \s+
+	          with: " "
+	        - template: "{dj} - {song}"
+	        - limit: 120
+	        - dedup: true
+
+replace substitutes matches of a regular expression, $1 and friends refer
+to groups. template rewrites the metadata, {song} is the metadata so far,
+{dj} the user sending it and {mount} the mount. limit cuts the metadata
+to a maximum amount of characters. block drops metadata matching a
+regular expression and dedup drops metadata that is the same as the
+metadata last sent upstream for the mount.
+*/
+func loadMetadataRules() {
+	node, err := yaml.Child(Config.Root, "metadata_rules")
+	if err != nil {
+		return
+	}
+
+	m, ok := node.(yaml.Map)
+	if !ok {
+		panic("Metadata rules configuration isn't a mapping.")
+	}
+
+	for mount, value := range m {
+		list, ok := value.(yaml.List)
+		if !ok {
+			panic("Metadata rules of " + mount + " isn't a list.")
+		}
+		rules := make([]MetadataRule, 0, len(list))
+		for _, item := range list {
+			settings, ok := item.(yaml.Map)
+			if !ok {
+				panic("Metadata rule of " + mount + " isn't a mapping.")
+			}
+			rules = append(rules, parseMetadataRule(mount, settings))
+		}
+		if mount != "default" {
+			mount = configMount(mount)
+		}
+		MetadataRules[mount] = rules
+	}
+}
+
+func parseMetadataRule(mount string, settings yaml.Map) MetadataRule {
+	get := func(key string) (string, bool) {
+		scalar, ok := settings[key].(yaml.Scalar)
+		return strings.Trim(string(scalar), `"'`), ok
+	}
+	compile := func(expression string) *regexp.Regexp {
+		pattern, err := regexp.Compile(expression)
+		if err != nil {
+			panic("Metadata rule of " + mount + " has an invalid expression: " + err.Error())
+		}
+		return pattern
+	}
+
+	if expression, ok := get("replace"); ok {
+		with, _ := get("with")
+		return MetadataRule{Kind: "replace", Pattern: compile(expression), Text: with}
+	}
+	if template, ok := get("template"); ok {
+		return MetadataRule{Kind: "template", Text: template}
+	}
+	if value, ok := get("limit"); ok {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit <= 0 {
+			panic("Metadata limit of " + mount + " isn't a valid number.")
+		}
+		return MetadataRule{Kind: "limit", Limit: limit}
+	}
+	if expression, ok := get("block"); ok {
+		return MetadataRule{Kind: "block", Pattern: compile(expression)}
+	}
+	if value, ok := get("dedup"); ok && value == "true" {
+		return MetadataRule{Kind: "dedup"}
+	}
+	panic("Metadata rule of " + mount + " isn't a known rule.")
+}
+
+/*
+Reads the optional "metadata_inputs" section of the configuration. It maps
+mount names to places that playout software without HTTP support can write
+metadata to.
+
+	metadata_inputs:
+	    /gopher.mp3:
+	        file: /var/run/playout/nowplaying.txt
+	        socket: /var/run/icecast-proxy/gopher.sock
+	        charset: latin1
+
+Every line added to file is sent as metadata for the source that is live
+on the mount, a file that is rewritten instead has its last line sent.
+socket is a Unix socket that is created and takes metadata a line at a
+time. charset is the charset of the metadata, it is guessed if left out.
+*/
+func loadMetadataInputs() {
+	node, err := yaml.Child(Config.Root, "metadata_inputs")
+	if err != nil {
+		return
+	}
+
+	m, ok := node.(yaml.Map)
+	if !ok {
+		panic("Metadata inputs configuration isn't a mapping.")
+	}
+
+	for mount, value := range m {
+		settings, ok := value.(yaml.Map)
+		if !ok {
+			panic("Metadata inputs of " + mount + " isn't a mapping.")
+		}
+
+		var input MetadataInput
+		for key, value := range settings {
+			scalar, ok := value.(yaml.Scalar)
+			if !ok {
+				continue
+			}
+			switch key {
+			case "file":
+				input.File = string(scalar)
+			case "socket":
+				input.Socket = string(scalar)
+			case "charset":
+				input.Charset = string(scalar)
+			default:
+				panic("Metadata inputs of " + mount + " has unknown setting " + key + ".")
+			}
+		}
+		if input.File == "" && input.Socket == "" {
+			panic("Metadata inputs of " + mount + " has neither a file nor a socket.")
+		}
+		MetadataInputs[configMount(mount)] = input
+	}
+}
+
+/*
+Reads the optional "now_playing" section of the configuration.
+
+	now_playing:
+	    path: /var/www/nowplaying
+	    webhooks:
+	        - http://example.com/hooks/nowplaying
+	    timeout: 5s
+	    retries: 3
+
+path is a directory that gets a text and a JSON file for every mount with
+what is playing on it. Every url in webhooks gets the JSON in a POST
+request, which is retried the amount of times given by retries when it
+fails or takes longer than timeout.
+*/
+func loadNowPlaying() {
+	node, err := yaml.Child(Config.Root, "now_playing")
+	if err != nil {
+		return
+	}
+
+	m, ok := node.(yaml.Map)
+	if !ok {
+		panic("Now playing configuration isn't a mapping.")
+	}
+
+	if scalar, ok := m["path"].(yaml.Scalar); ok {
+		NowPlayingPath = string(scalar)
+	}
+	if value, ok := m["webhooks"]; ok {
+		list, ok := value.(yaml.List)
+		if !ok {
+			panic("Now playing webhooks isn't a list.")
+		}
+		for _, item := range list {
+			if scalar, ok := item.(yaml.Scalar); ok {
+				Webhooks = append(Webhooks, strings.Trim(string(scalar), `"'`))
+			}
+		}
+	}
+	if scalar, ok := m["timeout"].(yaml.Scalar); ok {
+		timeout, err := time.ParseDuration(string(scalar))
+		if err != nil || timeout <= 0 {
+			panic("Now playing timeout isn't a valid duration.")
+		}
+		WebhookTimeout = timeout
+	}
+	if scalar, ok := m["retries"].(yaml.Scalar); ok {
+		retries, err := strconv.Atoi(string(scalar))
+		if err != nil || retries < 0 {
+			panic("Now playing retries isn't a valid number.")
+		}
+		WebhookRetries = retries
+	}
+}
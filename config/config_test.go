@@ -0,0 +1,45 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimitsFor(t *testing.T) {
+	DefaultLimits = Limits{Live: time.Hour, Warning: time.Minute, Wait: 10 * time.Minute}
+	MountLimits = map[string]Limits{
+		"/main.mp3":  {Live: 2 * time.Hour, Warning: -1, Wait: -1},
+		"/other.mp3": {Live: -1, Warning: -1, Wait: 0},
+	}
+	UserLimits = map[string]Limits{
+		"dj": {Live: 0, Warning: -1, Wait: -1},
+	}
+	defer func() {
+		DefaultLimits = Limits{}
+		MountLimits = map[string]Limits{}
+		UserLimits = map[string]Limits{}
+	}()
+
+	tests := []struct {
+		name  string
+		mount string
+		user  string
+		want  Limits
+	}{
+		{"defaults", "/unknown.mp3", "nobody", DefaultLimits},
+		{"mount", "/main.mp3", "nobody",
+			Limits{Live: 2 * time.Hour, Warning: time.Minute, Wait: 10 * time.Minute}},
+		{"mount disables", "/other.mp3", "nobody",
+			Limits{Live: time.Hour, Warning: time.Minute, Wait: 0}},
+		{"user", "/unknown.mp3", "dj",
+			Limits{Live: 0, Warning: time.Minute, Wait: 10 * time.Minute}},
+		{"user over mount", "/main.mp3", "DJ",
+			Limits{Live: 0, Warning: time.Minute, Wait: 10 * time.Minute}},
+	}
+
+	for _, test := range tests {
+		if got := LimitsFor(test.mount, test.user); got != test.want {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
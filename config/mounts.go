@@ -0,0 +1,255 @@
+package config
+
+import (
+	"github.com/kylelemons/go-gypsy/yaml"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The mounts sources may use by their name, empty if any mount is allowed.
+var Mounts = map[string]MountConfig{}
+
+// Canonical mount names by lower case mount name and alias.
+var mountNames = map[string]string{}
+
+/*
+MountConfig contains the settings of a single mount from the "mounts"
+section of the configuration.
+*/
+type MountConfig struct {
+	// Other names sources may use for the mount
+	Aliases []string
+	// The name of the mount on the icecast server
+	Upstream string
+	// Settings replacing the ones in the "icecast" section
+	Icecast map[string]string
+	// How many sources may wait in the queue, zero for QUEUE_LIMIT
+	QueueLimit int
+	// How long a source may go without sending anything, zero for Timeout
+	Timeout time.Duration
+	// The users that may be a source on the mount in lower case, empty
+	// if everyone may
+	Users []string
+	// How much later metadata is sent than the audio it belongs to
+	MetadataOffset time.Duration
+	// Indicates if MetadataOffset is set, otherwise it is the default
+	hasMetadataOffset bool
+}
+
+/*
+Reads the optional "mounts" section of the configuration. If it exists
+sources can only use the mounts listed in it.
+
+	mounts:
+	    /main.mp3:
+	        aliases: /live.mp3 /stream.mp3
+	        upstream: /radio.mp3
+	        host: icecast.example.com
+	        port: 8000
+	        passwd: secret
+	        name: Main Stream
+	        description: The main stream
+	        queue: 10
+	        timeout: 10s
+	        users: vin hanyuu
+	        metadata_offset: 2s
+
+aliases are other names for the same mount and upstream is the mount it
+is sent to on the icecast server, which defaults to its own name. Mount
+names and aliases are matched without regard to case or slashes at the
+end, in the other sections of the configuration as well.
+
+Any setting of the "icecast" section can be replaced for a single mount,
+such as host, port, passwd, format, name and description. queue is how
+many sources may wait in the queue, timeout is how long a source may go
+without sending anything and users lists who may be a source on the
+mount. metadata_offset replaces the offset of the "metadata" section.
+Anything left out is the same as for other mounts.
+*/
+func loadMounts() {
+	node, err := yaml.Child(Config.Root, "mounts")
+	if err != nil {
+		return
+	}
+
+	m, ok := node.(yaml.Map)
+	if !ok {
+		panic("Mounts configuration isn't a mapping.")
+	}
+
+	for name, value := range m {
+		name = NormaliseMount(name)
+		mount := MountConfig{Upstream: name, Icecast: map[string]string{}}
+
+		// A mount without any settings is allowed as well
+		settings, _ := value.(yaml.Map)
+		for key, value := range settings {
+			scalar, ok := value.(yaml.Scalar)
+			if !ok {
+				continue
+			}
+			parseMountSetting(name, &mount, key, string(scalar))
+		}
+
+		for _, key := range append([]string{name}, mount.Aliases...) {
+			if other, ok := mountNames[strings.ToLower(key)]; ok {
+				panic("Mount " + key + " is used by both " + other + " and " + name + ".")
+			}
+			mountNames[strings.ToLower(key)] = name
+		}
+		Mounts[name] = mount
+	}
+}
+
+func parseMountSetting(name string, mount *MountConfig, key string, value string) {
+	switch key {
+	case "aliases":
+		for _, alias := range strings.Fields(value) {
+			mount.Aliases = append(mount.Aliases, NormaliseMount(alias))
+		}
+	case "upstream", "mount":
+		mount.Upstream = value
+	case "queue":
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 0 {
+			panic("Queue length of " + name + " isn't a valid number.")
+		}
+		mount.QueueLimit = limit
+	case "timeout":
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout <= 0 {
+			panic("Timeout of " + name + " isn't a valid duration.")
+		}
+		mount.Timeout = timeout
+	case "users":
+		for _, user := range strings.Fields(value) {
+			mount.Users = append(mount.Users, strings.ToLower(user))
+		}
+	case "metadata_offset":
+		offset, err := time.ParseDuration(value)
+		if err != nil {
+			panic("Metadata offset of " + name + " isn't a valid duration.")
+		}
+		mount.MetadataOffset = offset
+		mount.hasMetadataOffset = true
+	case "password":
+		mount.Icecast["passwd"] = value
+	default:
+		mount.Icecast[key] = value
+	}
+}
+
+/*
+Returns the mount name with a slash in front and without any at the end.
+*/
+func NormaliseMount(mount string) string {
+	return "/" + strings.Trim(mount, "/")
+}
+
+/*
+Returns the name of the configured mount a source asked for, resolving
+aliases and differences in case. The second return value is false if the
+mount isn't configured. Without a "mounts" section every mount is allowed
+and only normalised.
+*/
+func ResolveMount(mount string) (string, bool) {
+	mount = NormaliseMount(mount)
+	if len(Mounts) == 0 {
+		return mount, true
+	}
+	name, ok := mountNames[strings.ToLower(mount)]
+	if !ok {
+		return mount, false
+	}
+	return name, true
+}
+
+/*
+Returns the name a mount in one of the per-mount sections of the
+configuration is known by, so aliases and differences in case work there
+as well. Mounts that aren't in the "mounts" section are only normalised,
+such as one that only plays a fallback.
+*/
+func configMount(mount string) string {
+	name, _ := ResolveMount(mount)
+	return name
+}
+
+/*
+Returns the name of the mount on the icecast server.
+*/
+func UpstreamMount(mount string) string {
+	if settings, ok := Mounts[mount]; ok && settings.Upstream != "" {
+		return settings.Upstream
+	}
+	return mount
+}
+
+/*
+Returns the settings to pass to shout.NewShout for a mount, these are the
+ones of the "icecast" section with those of the mount applied on top.
+*/
+func CreateMountShoutMap(mount string) map[string]string {
+	options := CreateShoutMap()
+	for key, value := range Mounts[mount].Icecast {
+		options[key] = value
+	}
+	options["mount"] = UpstreamMount(mount)
+	return options
+}
+
+/*
+Returns the audio format configured for a mount, "" if there is none.
+*/
+func MountFormat(mount string) string {
+	return Mounts[mount].Icecast["format"]
+}
+
+/*
+Returns how many sources may wait in the queue of a mount.
+*/
+func QueueLimit(mount string) int {
+	if limit := Mounts[mount].QueueLimit; limit > 0 {
+		return limit
+	}
+	return QUEUE_LIMIT
+}
+
+/*
+Returns how long a source on a mount may go without sending anything.
+*/
+func ReadTimeout(mount string) time.Duration {
+	if timeout := Mounts[mount].Timeout; timeout > 0 {
+		return timeout
+	}
+	return Timeout
+}
+
+/*
+Returns how much later metadata on a mount is sent than the audio it
+belongs to, negative if it is sent earlier.
+*/
+func MetadataOffset(mount string) time.Duration {
+	if settings := Mounts[mount]; settings.hasMetadataOffset {
+		return settings.MetadataOffset
+	}
+	return DefaultMetadataOffset
+}
+
+/*
+Returns true if the user may be a source on the mount.
+*/
+func AllowedUser(mount string, user string) bool {
+	users := Mounts[mount].Users
+	if len(users) == 0 {
+		return true
+	}
+	user = strings.ToLower(user)
+	for _, allowed := range users {
+		if allowed == user {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"github.com/Wessie/icecast-proxy-go/config"
+)
+
+/*
+Returns the name of the mount whose audio a mount should carry, which is
+the first mount with a live client or a playing fallback found by
+following the fallback mounts. "" is returned if the mount has a live
+client itself or there is nothing to carry.
+*/
+func (self *Manager) CarriedMount(mount *Mount) string {
+	if mount.Active != nil {
+		return ""
+	}
+
+	seen := map[string]bool{mount.Mount: true}
+	name := config.FallbackMounts[mount.Mount]
+	for name != "" && !seen[name] {
+		seen[name] = true
+		if next, ok := self.Mounts[name]; ok && next.Playing() {
+			if next.Format != mount.Format {
+				// The upstream can't switch formats halfway
+				return ""
+			}
+			return name
+		}
+		name = config.FallbackMounts[name]
+	}
+	return ""
+}
+
+/*
+Returns true if the mount sends audio of its own, from a live client or
+its fallback.
+*/
+func (self *Mount) Playing() bool {
+	return self.Active != nil || self.Carrying == "" && self.Fallback != nil &&
+		self.Fallback.Running()
+}
+
+/*
+Decides again which mounts carry the audio of another mount, this has to
+be called whenever a mount gains or loses its live client. Fallbacks
+starting and stopping are picked up by the mount ticker.
+*/
+func (self *Manager) UpdateCarriers() {
+	for name, mount := range self.Mounts {
+		if _, ok := config.FallbackMounts[name]; !ok {
+			continue
+		}
+
+		carried := self.CarriedMount(mount)
+		if carried == mount.Carrying {
+			continue
+		}
+		logger.Printf(":fallback mount:%s: '%s' -> '%s'", name,
+			mount.Carrying, carried)
+		mount.Carrying = carried
+
+		if carried == "" {
+			// Our own source is back or the chain ran dry, in which case
+			// the fallback files can take over.
+			mount.WhenSent(mount.StartFallback)
+			continue
+		}
+
+		carrier := mount
+		carrier.WhenSent(func() {
+			carrier.StopFallback()
+			carrier.resync = true
+		})
+
+		// Tell the listeners what they are hearing now
+		source := self.Mounts[carried]
+		if client, ok := source.Clients.GetByID(source.Active); ok &&
+			client.Metadata != "" {
+			carrier.SendMetadata(HistoryEntry{Metadata: client.Metadata,
+				Track: client.Track, User: client.ClientID.Name})
+		}
+	}
+}
+
+/*
+Makes the mounts carrying the mount send the headers of its new source
+along with the first audio of it, this has to be called whenever the
+source of a mount changes.
+*/
+func (self *Manager) ResyncCarriers(mount *Mount) {
+	for _, carrier := range self.Mounts {
+		if carrier.Carrying == mount.Mount {
+			carrier := carrier
+			carrier.WhenSent(func() { carrier.resync = true })
+		}
+	}
+}
+
+/*
+Sends audio of the fallback of the mount we carry, along with the title of
+the track starting with it.
+*/
+func (self *Mount) CarryPlay(play *PlayPack) {
+	if play.Title != "" {
+		if self.tagger != nil {
+			// The files carry their own comments
+			self.tagger.SetTags(nil)
+			self.recordMetadata(HistoryEntry{Metadata: play.Title},
+				self.Shout.Connected())
+		} else {
+			self.SendMetadata(HistoryEntry{Metadata: play.Title})
+		}
+	}
+	self.HandleData(&DataPack{Data: play.Data, Headers: play.Headers})
+}
@@ -8,7 +8,10 @@ import (
 	"net"
 	"strings"
 	"sync/atomic"
+	"time"
 
+	"github.com/Wessie/icecast-proxy-go/audio"
+	"github.com/Wessie/icecast-proxy-go/config"
 	"github.com/Wessie/icecast-proxy-go/http"
 )
 
@@ -104,6 +107,9 @@ func NewClientIDFromRequest(r *http.Request) (client *ClientID) {
 	} else {
 		client.Mount = path
 	}
+	// Use the configured name of the mount, unknown mounts are rejected
+	// by the handlers.
+	client.Mount, _ = config.ResolveMount(client.Mount)
 	// The user should have no permissions on creation.
 	client.Perm = PERM_NONE
 
@@ -135,15 +141,40 @@ func (self *ClientID) Hash() ClientHash {
 
 type ClientHash uint64
 
+// The serial number given to the last client created.
+var lastSerial uint64
+
 type Client struct {
 	// identifier of the client
 	ClientID *ClientID
+	// A number unique to this connection, used to refer to the client
+	// from outside the manager
+	Serial uint64
 	// Metadata send by this client (mp3 only)
 	Metadata string
+	// The structured form of Metadata, nil if it was sent as text
+	Track *Track
 	// ReadWriter around the connection socket
 	Bufrw *bufio.ReadWriter
+	// Splits the audio into frames, nil if the format is unknown
+	Framer *audio.Framer
 	// The raw connection socket
 	Conn net.Conn
+	// Signal level meter of the audio, nil if silence detection is disabled
+	Meter *audio.Meter
+	// Set when the client is live and has been reported as dead air
+	DeadAir bool
+	// The queue priority of the client, see PriorityOf
+	Priority int
+	// Set when the client was kicked or replaced by a new connection,
+	// its slot isn't held for it
+	Kicked bool
+	// The time the client went live, zero if it isn't live
+	LiveSince time.Time
+	// The time the client was put in the queue, zero if it isn't queued
+	QueuedSince time.Time
+	// Set when the client has been warned about its live time running out
+	Warned bool
 }
 
 /* Returns a pretty string that contains information about the client.
@@ -156,10 +187,31 @@ func (self *Client) String() string {
 func NewClient(conn net.Conn, bufrw *bufio.ReadWriter,
 	clientID *ClientID) *Client {
 
-	new := Client{clientID, "", bufrw, conn}
+	new := Client{ClientID: clientID, Bufrw: bufrw, Conn: conn,
+		Serial: atomic.AddUint64(&lastSerial, 1), Priority: PriorityOf(clientID)}
+
+	if clientID.AudioFormat != "" {
+		new.Framer = audio.NewFramer(clientID.AudioFormat)
+	}
+
+	if config.SilenceDuration > 0 {
+		new.Meter = audio.NewMeter(clientID.AudioFormat, config.SilenceThreshold)
+	}
 	return &new
 }
 
+/*
+Forgets the silence of the client measured so far, done whenever it goes
+live or is demoted so an earlier stretch of silence doesn't count against
+it.
+*/
+func (self *Client) resetDeadAir() {
+	self.DeadAir = false
+	if self.Meter != nil {
+		self.Meter.Reset()
+	}
+}
+
 /*
 Container that makes it easier to handle fuzzy and exact matching
 when it comes to clients. Since we don't want to clutter logic code
@@ -196,6 +248,40 @@ func (self *ClientContainer) GetByID(id *ClientID) (client *Client, ok bool) {
 	return client, ok
 }
 
+/*
+Gets a client from the container by its serial number
+
+*/
+func (self *ClientContainer) GetBySerial(serial uint64) (client *Client, ok bool) {
+	for _, client := range self.byID {
+		if client.Serial == serial {
+			return client, true
+		}
+	}
+	return nil, false
+}
+
+/*
+Gets a client from the container by the user name, ignoring case. If the
+user is connected more than once any of them is returned.
+*/
+func (self *ClientContainer) GetByName(name string) (client *Client, ok bool) {
+	return self.GetOtherByName(name, nil)
+}
+
+/*
+Gets a client from the container by the user name like GetByName, but
+never returns the client given.
+*/
+func (self *ClientContainer) GetOtherByName(name string, except *Client) (client *Client, ok bool) {
+	for id, client := range self.byID {
+		if client != except && strings.EqualFold(id.Name, name) {
+			return client, true
+		}
+	}
+	return nil, false
+}
+
 /*
 Adds a client to the container.
 
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"time"
+
+	"github.com/Wessie/icecast-proxy-go/config"
+)
+
+/*
+metadataCue is metadata waiting for the live audio that was received before
+it to be sent upstream.
+
+Live audio is counted in bytes as it comes into the mount and as it goes
+out, after the delay buffer and any jingle holding it back. The metadata is
+sent once the count going out reaches the count coming in at the time the
+metadata arrived, which keeps it in step with the audio regardless of what
+held the audio back.
+*/
+type metadataCue struct {
+	// The amount of live audio received before the metadata, in bytes
+	position uint64
+	// The time the metadata arrived
+	at time.Time
+	// The time the audio in front of it was sent, zero if it hasn't been
+	reached time.Time
+	// The metadata to send
+	entry HistoryEntry
+}
+
+/*
+Sends the metadata of the history entry to the icecast server once the
+live audio received before it has been sent, moved by the metadata offset
+of the mount.
+*/
+func (self *Mount) SendMetadata(entry HistoryEntry) {
+	now := time.Now()
+	self.cues = append(self.cues,
+		metadataCue{position: self.received, at: now, entry: entry})
+	self.ReleaseMetadata(now)
+}
+
+/*
+Returns the metadata the icecast server ends up with once the metadata
+waiting for its audio has been sent.
+*/
+func (self *Mount) upstreamMetadata() string {
+	if len(self.cues) > 0 {
+		return self.cues[len(self.cues)-1].entry.Metadata
+	}
+	return self.metadata.Metadata
+}
+
+/*
+Sends all metadata that is due. A positive offset sends metadata that much
+later than the audio it belongs to, a negative one earlier, but never
+earlier than the metadata arrived.
+*/
+func (self *Mount) ReleaseMetadata(now time.Time) {
+	offset := config.MetadataOffset(self.Mount)
+	for len(self.cues) > 0 {
+		cue := &self.cues[0]
+		if cue.reached.IsZero() && self.sent >= cue.position {
+			cue.reached = now
+		}
+
+		var due bool
+		switch {
+		case !cue.reached.IsZero():
+			due = now.Sub(cue.reached) >= offset
+		case offset < 0:
+			// The audio will be sent once the delay buffer releases it
+			var held time.Duration
+			if self.Delay != nil {
+				held = self.Delay.current
+			}
+			if len(self.held) > 0 {
+				// and once the audio held back by a jingle has caught up
+				held += self.heldLag
+			}
+			due = now.Sub(cue.at) >= held+offset
+		}
+		if !due {
+			return
+		}
+
+		entry := cue.entry
+		self.cues[0] = metadataCue{}
+		self.cues = self.cues[1:]
+		self.sendMetadataNow(entry)
+	}
+}
+
+/*
+Counts live audio that is never going to be sent as sent, so metadata
+waiting for it isn't stuck.
+*/
+func (self *Mount) skipLive(data *DataPack) {
+	self.sent += uint64(len(data.Data))
+}
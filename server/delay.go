@@ -0,0 +1,201 @@
+package server
+
+import (
+	"time"
+
+	"github.com/Wessie/icecast-proxy-go/config"
+)
+
+// How much longer live audio plays between refills than each refill takes,
+// so the delay builds back up at a tenth of real time.
+const delayRefillSpacing = 10
+
+/*
+Delay holds back the live audio of a mount for a fixed duration before it
+is sent upstream, this gives an admin the chance to dump anything that
+shouldn't go out.
+
+After a dump the live audio goes out right away, and the delay is built
+back up gradually. Every so often the live audio is held back for a
+moment while the fallback or silence covers for it, see startCover.
+
+Anything that has to happen in step with the audio, such as handovers
+between clients, is kept in the same buffer so it happens once the audio in
+front of it has been sent. Metadata keeps in step by itself, see
+metadataCue.
+*/
+type Delay struct {
+	// How long live audio is held back
+	Duration time.Duration
+	// What covers for the live audio while the delay builds back up,
+	// "fallback" or "silence"
+	Dump string
+	// How much the delay grows at a time while building back up
+	Refill time.Duration
+	// Audio and actions waiting to be released, oldest first
+	entries []delayed
+	// How long live audio is held back right now, less than Duration
+	// while the delay builds back up after a dump
+	current time.Duration
+	// Set while something covers for the live audio
+	covering bool
+	// The time the live audio takes over again from the cover
+	coverUntil time.Time
+	// The earliest time of the next refill
+	nextRefill time.Time
+}
+
+/*
+delayed is a single entry in the delay buffer, either live data or an
+action to run.
+*/
+type delayed struct {
+	// The time the entry was added
+	at time.Time
+	// The data to send, nil for actions
+	data *DataPack
+	// The action to run, nil for data
+	action func()
+}
+
+func NewDelay(settings config.Delay) *Delay {
+	return &Delay{Duration: settings.Duration, Dump: settings.Dump,
+		Refill: settings.Refill, current: settings.Duration,
+		entries: make([]delayed, 0, 64)}
+}
+
+/*
+Returns the amount of time the oldest entry in the buffer has been
+waiting for.
+*/
+func (self *Delay) Buffered(now time.Time) time.Duration {
+	if len(self.entries) == 0 {
+		return 0
+	}
+	return now.Sub(self.entries[0].at)
+}
+
+/*
+Runs the action once all delayed audio in front of it has been sent, or
+right away if the mount has no delay or nothing is waiting.
+*/
+func (self *Mount) WhenSent(action func()) {
+	if self.Delay == nil || len(self.Delay.entries) == 0 {
+		action()
+		return
+	}
+	self.Delay.entries = append(self.Delay.entries,
+		delayed{at: time.Now(), action: action})
+}
+
+/*
+Sends all delayed data that has been held back long enough, and runs the
+actions queued behind it. This also moves the delay along while it builds
+back up after a dump.
+*/
+func (self *Mount) ReleaseDelayed(now time.Time) {
+	delay := self.Delay
+	switch {
+	case self.Active == nil && len(delay.entries) == 0 && !delay.covering:
+		// Nobody is waiting for the delay, the next client gets all of it
+		delay.current = delay.Duration
+	case delay.covering && !now.Before(delay.coverUntil):
+		self.stopCover(now)
+	case !delay.covering && delay.current < delay.Duration &&
+		self.Active != nil && !now.Before(delay.nextRefill):
+		self.startCover(now)
+	}
+
+	for len(delay.entries) > 0 {
+		entry := delay.entries[0]
+		if entry.data != nil &&
+			(delay.covering || now.Sub(entry.at) < delay.current) {
+			break
+		}
+		delay.entries[0] = delayed{}
+		delay.entries = delay.entries[1:]
+
+		if entry.action != nil {
+			entry.action()
+			continue
+		}
+		self.sendLive(entry.data)
+	}
+}
+
+/*
+Grows the delay by a refill, the live audio is held back for that long
+while the fallback or silence covers for it.
+*/
+func (self *Mount) startCover(now time.Time) {
+	delay := self.Delay
+	step := delay.Refill
+	if left := delay.Duration - delay.current; step > left {
+		step = left
+	}
+	delay.current += step
+	delay.covering = true
+	delay.coverUntil = now.Add(step)
+	self.resync = true
+	logger.Printf(":delay refill:%s: %s of %s", self.Mount, delay.current,
+		delay.Duration)
+
+	if delay.Dump == "fallback" && self.Fallback != nil {
+		self.Fallback.Start(self.plays)
+	} else if !self.filling {
+		self.startFilling(now)
+		self.FillSilence(now)
+	}
+}
+
+/*
+Hands the upstream back to the live audio after a refill.
+*/
+func (self *Mount) stopCover(now time.Time) {
+	delay := self.Delay
+	logger.Printf(":delay resume: %s", self.Mount)
+	delay.covering = false
+	delay.nextRefill = now.Add(delay.Refill * delayRefillSpacing)
+	if self.Active != nil && self.Fallback != nil && self.Fallback.Running() {
+		self.Fallback.Stop()
+	}
+	self.resync = true
+}
+
+/*
+Drops all live audio that is waiting in the delay buffer, the live audio
+continues right away and the delay builds back up from nothing. Queued
+actions are kept and run right away.
+*/
+func (self *Mount) DumpDelay(now time.Time) {
+	delay := self.Delay
+	if delay == nil {
+		return
+	}
+	logger.Printf(":delay dump:%s: %s", self.Mount, delay.Buffered(now))
+
+	entries := delay.entries
+	delay.entries = make([]delayed, 0, 64)
+	for _, entry := range entries {
+		if entry.action != nil {
+			entry.action()
+		} else {
+			self.skipLive(entry.data)
+		}
+	}
+
+	// Whatever was held back behind a jingle went through the delay too.
+	for _, entry := range self.held {
+		self.skipLive(entry.data)
+	}
+	self.held = nil
+
+	delay.current = 0
+	if delay.covering {
+		// The live audio has nothing left to catch up with
+		self.stopCover(now)
+	}
+	// Cover the cut right away, the first refill starts now
+	delay.nextRefill = now
+	self.resync = true
+}
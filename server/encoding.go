@@ -1,23 +1,18 @@
 package server
 
 import (
-	"log"
-	iconv "github.com/Wessie/go-iconv"
+	"github.com/Wessie/icecast-proxy-go/charset"
 )
 
-func ParseMetadata(charset string, meta string) (metadata string) {
-	if charset == "latin1" {
-		log.Printf("latin1")
-		if res, err := iconv.Conv(meta, "UTF-8", "UTF-8"); err == nil {
-			metadata = res
-		} else if res, err := iconv.Conv(meta, "UTF-8", "SHIFT_JIS"); err == nil {
-			metadata = res
-		} else {
-			//metadata, _ = iconv.Conv(meta, "UTF8//TRANSLIT", "UTF8")
-		}
-	} else {
-		metadata = meta
+/*
+Converts metadata sent by a source to UTF-8. name is the charset the
+source says it used, "" if it didn't say. See charset.Decode for how the
+encoding is guessed when the source got it wrong.
+*/
+func ParseMetadata(name string, meta string) string {
+	decoded, err := charset.Decode(name, meta)
+	if err != nil {
+		logger.Printf(":metadata charset: %s", err.Error())
 	}
-
-	return metadata
+	return decoded
 }
@@ -2,12 +2,45 @@ package server
 
 import (
 	"sync"
+	"time"
 )
 
 var HandlerMounts map[string][]*Client = map[string][]*Client{}
 
 var HandlerLock sync.Mutex = sync.Mutex{}
 
+/*
+ClientStatus is a copy of the parts of a Client the manager keeps changing,
+taken whenever one of the handlers is called for it. The http handlers
+read these instead, the Client itself belongs to the manager.
+*/
+type ClientStatus struct {
+	// The time the client went live, zero if it isn't live
+	LiveSince time.Time
+	// The time the client was put in the queue, zero if it isn't queued
+	QueuedSince time.Time
+	// The latest metadata of the client
+	Metadata string
+	// The structured form of the metadata, nil if it was sent as text
+	Track *Track
+}
+
+var HandlerStatus map[*Client]ClientStatus = map[*Client]ClientStatus{}
+
+/*
+Copies the state of the client into HandlerStatus, HandlerLock has to be
+held by the caller.
+*/
+func snapshotClient(client *Client) {
+	status := ClientStatus{LiveSince: client.LiveSince,
+		QueuedSince: client.QueuedSince, Metadata: client.Metadata}
+	if client.Track != nil {
+		track := *client.Track
+		status.Track = &track
+	}
+	HandlerStatus[client] = status
+}
+
 /*
 Called whenever a new client connects.
 */
@@ -21,6 +54,7 @@ func HandleClientConnect(client *Client) {
 	}
 	Clients = append(Clients, client)
 	HandlerMounts[client.ClientID.Mount] = Clients
+	snapshotClient(client)
 	HandlerLock.Unlock()
 }
 
@@ -30,8 +64,10 @@ members has undefined behaviour at this point.
 */
 func HandleClientDisconnect(client *Client) {
 	HandlerLock.Lock()
+	delete(HandlerStatus, client)
 	Clients, ok := HandlerMounts[client.ClientID.Mount]
 	if !ok {
+		HandlerLock.Unlock()
 		return
 	}
 	for i, c := range Clients {
@@ -55,10 +91,13 @@ icecast server for this client. When a client isn't in the 'live' mode
 all data received is discarded.
 */
 func HandleClientLive(client *Client) {
+	HandlerLock.Lock()
+	defer HandlerLock.Unlock()
 	Clients, ok := HandlerMounts[client.ClientID.Mount]
 	if !ok {
 		return
 	}
+	snapshotClient(client)
 	for i, c := range Clients {
 		if c == client {
 			Clients = append([]*Client{c}, append(Clients[:i], Clients[i+1:]...)...)
@@ -73,16 +112,92 @@ Called whenever a client is removed from 'live' mode. See `HandleClientLive`
 for a short description of the 'live' mode.
 */
 func HandleClientUnlive(client *Client) {
+	HandlerLock.Lock()
+	if _, ok := HandlerStatus[client]; ok {
+		snapshotClient(client)
+	}
+	HandlerLock.Unlock()
+}
 
+/*
+Called whenever the order of the clients on a mount might have changed,
+such as after an admin moved one of them. The order given starts with the
+live client followed by the queue.
+*/
+func HandleQueueChange(mount string, order []*Client) {
+	HandlerLock.Lock()
+	Clients, ok := HandlerMounts[mount]
+	if !ok {
+		HandlerLock.Unlock()
+		return
+	}
+	// Clients we don't know the place of yet keep their order at the end.
+	sorted := make([]*Client, 0, len(Clients))
+	for _, c := range order {
+		for _, known := range Clients {
+			if c == known {
+				sorted = append(sorted, c)
+				snapshotClient(c)
+				break
+			}
+		}
+	}
+	for _, c := range Clients {
+		found := false
+		for _, placed := range order {
+			found = found || c == placed
+		}
+		if !found {
+			sorted = append(sorted, c)
+		}
+	}
+	HandlerMounts[mount] = sorted
+	HandlerLock.Unlock()
 }
 
 /*
-Called whenever new metadata is received for a client.
+Called whenever new metadata is received for a client. The structured
+form is in client.Track if the client sent one.
 
 Repeated sends of the same metadata won't call this handler multiple
 times. The same applies to rejected metadata, this won't call this
 handler if the metadata is not accepted.
 */
 func HandleMetadata(client *Client, metadata string) {
+	HandlerLock.Lock()
+	if _, ok := HandlerStatus[client]; ok {
+		snapshotClient(client)
+	}
+	HandlerLock.Unlock()
+}
 
+/*
+Called whenever metadata has reached the icecast server, the metadata of
+a client as well as fallback titles. This updates the now playing files
+and webhooks, see PublishNowPlaying.
+*/
+func HandleMetadataSent(mount string, entry HistoryEntry) {
+	PublishNowPlaying(mount, entry)
+}
+
+/*
+Called when the live client is about to reach the maximum time it may stay
+live, the remaining time is passed along. The next client in the queue
+takes over once it runs out, if there is one.
+*/
+func HandleLiveWarning(client *Client, remaining time.Duration) {
+	logger.Printf(":event:live warning:%s: %s (%s left)", client.ClientID.Mount,
+		client.String(), remaining)
+}
+
+/*
+Called whenever the live client has been sending audio below the silence
+threshold for longer than the configured duration.
+
+This is called once for every stretch of silence, the client has to send
+audio above the threshold again before it can be reported another time.
+*/
+func HandleDeadAir(client *Client, silence time.Duration) {
+	logger.Printf(":event:dead air:%s: %s (silent for %s)", client.ClientID.Mount,
+		client.String(), silence)
 }
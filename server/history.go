@@ -0,0 +1,297 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Wessie/icecast-proxy-go/config"
+)
+
+/*
+HistoryEntry is a single metadata change on a mount.
+*/
+type HistoryEntry struct {
+	// The time the metadata changed
+	Time time.Time `json:"time"`
+	// The metadata in UTF-8 format
+	Metadata string `json:"metadata"`
+	// The metadata as the client sent it, "" if it wasn't rewritten
+	Original string `json:"original,omitempty"`
+	// The structured form of the metadata, nil if it was sent as text
+	Track *Track `json:"track,omitempty"`
+	// The user that sent the metadata, "" for the fallback
+	User string `json:"user"`
+	// Indicates if the metadata reached the icecast server
+	Sent bool `json:"sent"`
+}
+
+/*
+History keeps the last metadata changes of a mount, optionally persisted
+to a file with one JSON entry per line.
+
+Histories outlive the mounts they belong to and are read by the HTTP
+handlers, so they have their own lock.
+*/
+type History struct {
+	// The mount the history belongs to
+	Mount string
+	// The entries, oldest first
+	entries []HistoryEntry
+	// The file the history is persisted to, "" if it isn't
+	path string
+	// The amount of lines in the file, used to decide when to compact it
+	lines int
+	lock  sync.Mutex
+}
+
+var histories = map[string]*History{}
+var historiesLock sync.Mutex
+
+/*
+Returns the history of a mount, it is loaded from disk the first time it
+is asked for.
+*/
+func MountHistory(mount string) *History {
+	historiesLock.Lock()
+	defer historiesLock.Unlock()
+
+	if history, ok := histories[mount]; ok {
+		return history
+	}
+
+	history := &History{Mount: mount}
+	if config.HistoryPath != "" {
+		history.path = filepath.Join(config.HistoryPath, mountFileName(mount)+".jsonl")
+		if err := history.load(); err != nil && !os.IsNotExist(err) {
+			logger.Printf(":history error:%s: %s", mount, err.Error())
+		}
+	}
+	histories[mount] = history
+	return history
+}
+
+/*
+Returns the name used for files belonging to a mount, without extension.
+*/
+func mountFileName(mount string) string {
+	return strings.Replace(strings.Trim(mount, "/"), "/", "_", -1)
+}
+
+/*
+Returns the names of all mounts with a history, the ones in memory and the
+ones persisted to disk, sorted by name.
+*/
+func HistoryMounts() []string {
+	historiesLock.Lock()
+	defer historiesLock.Unlock()
+
+	found := make(map[string]bool, len(histories))
+	for mount := range histories {
+		found[mount] = true
+	}
+
+	if config.HistoryPath != "" {
+		files, err := filepath.Glob(filepath.Join(config.HistoryPath, "*.jsonl"))
+		if err != nil {
+			logger.Printf(":history error: %s", err.Error())
+		}
+		for _, file := range files {
+			found[historyFileMount(strings.TrimSuffix(filepath.Base(file), ".jsonl"))] = true
+		}
+	}
+
+	mounts := make([]string, 0, len(found))
+	for mount := range found {
+		mounts = append(mounts, mount)
+	}
+	sort.Strings(mounts)
+	return mounts
+}
+
+/*
+Returns the mount a history file belongs to from the name of the file.
+mountFileName can't be undone for mounts containing a slash, so those are
+looked up among the mounts we know of. historiesLock has to be held.
+*/
+func historyFileMount(name string) string {
+	for mount := range histories {
+		if mountFileName(mount) == name {
+			return mount
+		}
+	}
+	for mount := range config.Mounts {
+		if mountFileName(mount) == name {
+			return mount
+		}
+	}
+	return "/" + name
+}
+
+/*
+Adds an entry to the history, dropping the oldest one if the history is
+full.
+*/
+func (self *History) Add(entry HistoryEntry) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.entries = append(self.entries, entry)
+	if over := len(self.entries) - config.HistoryLength; over > 0 {
+		self.entries = append(self.entries[:0], self.entries[over:]...)
+	}
+
+	if self.path == "" {
+		return
+	}
+	// Rewriting the whole file every time would be wasteful, so we append
+	// and only compact once the file is twice as long as it needs to be.
+	var err error
+	if self.lines >= config.HistoryLength*2 {
+		err = self.save()
+	} else {
+		err = self.append(entry)
+	}
+	if err != nil {
+		logger.Printf(":history error:%s: %s", self.Mount, err.Error())
+	}
+}
+
+/*
+Marks an entry that was added before it could be sent as sent, once it
+reached the icecast server after all. Entries that dropped out of the
+history are left alone.
+*/
+func (self *History) MarkSent(entry HistoryEntry) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	for i := len(self.entries) - 1; i >= 0; i-- {
+		stored := &self.entries[i]
+		if !stored.Time.Equal(entry.Time) || stored.Metadata != entry.Metadata {
+			continue
+		}
+		if stored.Sent {
+			return
+		}
+		stored.Sent = true
+		// Rare enough that rewriting the file is fine
+		if self.path != "" {
+			if err := self.save(); err != nil {
+				logger.Printf(":history error:%s: %s", self.Mount, err.Error())
+			}
+		}
+		return
+	}
+}
+
+/*
+Returns the entries between the times given, a zero time leaves that side
+open. The newest entries come first, at most limit of them if it isn't
+zero. sentOnly leaves out metadata that didn't reach the icecast server,
+such as that of clients waiting in the queue.
+*/
+func (self *History) Between(from, to time.Time, limit int, sentOnly bool) []HistoryEntry {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	entries := make([]HistoryEntry, 0, 20)
+	for i := len(self.entries) - 1; i >= 0; i-- {
+		entry := self.entries[i]
+		if !to.IsZero() && entry.Time.After(to) {
+			continue
+		}
+		if !from.IsZero() && entry.Time.Before(from) {
+			break
+		}
+		if sentOnly && !entry.Sent {
+			continue
+		}
+		entries = append(entries, entry)
+		if limit > 0 && len(entries) >= limit {
+			break
+		}
+	}
+	return entries
+}
+
+func (self *History) load() error {
+	f, err := os.Open(self.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry HistoryEntry
+		if json.Unmarshal(scanner.Bytes(), &entry) != nil {
+			// Most likely a line cut short by a crash
+			continue
+		}
+		self.entries = append(self.entries, entry)
+	}
+	if over := len(self.entries) - config.HistoryLength; over > 0 {
+		self.entries = self.entries[over:]
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return self.save()
+}
+
+func (self *History) append(entry HistoryEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(self.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	self.lines++
+	return nil
+}
+
+/*
+Writes the entries in memory to the file, replacing it.
+*/
+func (self *History) save() error {
+	temp := self.path + ".tmp"
+	f, err := os.Create(temp)
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(f)
+	encoder := json.NewEncoder(writer)
+	for _, entry := range self.entries {
+		if err = encoder.Encode(entry); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(temp)
+		return err
+	}
+
+	self.lines = len(self.entries)
+	return os.Rename(temp, self.path)
+}
@@ -15,10 +15,15 @@ import (
 	"github.com/Wessie/icecast-proxy-go/http"
 	"fmt"
 	"io"
+	"net"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 	"log"
 	"encoding/hex"
+	"encoding/json"
+	"html"
 )
 
 var AdminHTML string = `
@@ -36,11 +41,12 @@ form{margin:0;padding:0;}
 
 var MountHTML string = `
 <table width="800px" cellspacing="0" cellpadding="2">
-<tr><th align="left" colspan="5">%s</th></tr>
+<tr><th align="left" colspan="5">%s%s</th></tr>
 <tr><th width="80px">Username</th>
 <th>Metadata</th>
 <th width="150px">Useragent</th>
-<th width="50px">Kick</th></tr>
+<th width="120px">Time</th>
+<th width="220px">Actions</th></tr>
 %s
 </table>
 `
@@ -50,12 +56,72 @@ var ClientHTML string = `
 <td>%s &nbsp;</td>
 <td>%s &nbsp;</td>
 <td>%s &nbsp;</td>
-<td>
-<form action="/admin/kick" method="GET">
+<td>%s &nbsp;</td>
+<td>%s</td></tr>
+`
+
+var ActionHTML string = `
+<form action="/admin/%s" method="GET" style="display:inline">
+<input type="hidden" name="mount" value="%s" />
+<input type="hidden" name="id" value="%d" />
+<input type="submit" value="%s" />
+</form>
+`
+
+var ModeHTML string = `
+<p>%s: <b>%s</b> %s</p>
+`
+
+var LockHTML string = `
+<form action="/admin/lock" method="GET">
+<input type="text" name="mount" />
+<input type="submit" value="Lock mount" />
+</form>
+`
+
+var HistoryHTML string = `
+<form action="/admin/history" method="GET">
+Mount <select name="mount">%s</select>
+From <input type="text" name="from" value="%s" />
+To <input type="text" name="to" value="%s" />
+<input type="submit" value="Search" />
+</form>
+<table width="800px" cellspacing="0" cellpadding="2">
+<tr><th width="150px">Time</th>
+<th width="80px">Username</th>
+<th>Metadata</th>
+<th>Original</th>
+<th width="50px">Sent</th></tr>
+%s
+</table>
+`
+
+var HistoryEntryHTML string = `
+<tr><td>%s</td><td>%s &nbsp;</td><td>%s &nbsp;</td><td>%s &nbsp;</td><td>%t</td></tr>
+`
+
+// The time format used by the history page, in local time.
+const historyTime = "2006-01-02 15:04:05"
+
+// Actions offered for changing the mode of the server or a mount.
+var modeActions = [][2]string{{"lock", "Lock"}, {"unlock", "Unlock"},
+	{"drain", "Drain"}}
+
+// Actions offered for the live client and for clients in the queue.
+var liveActions = [][2]string{{"demote", "Demote"}, {"kick", "Kick"}}
+var queueActions = [][2]string{{"promote", "Promote"}, {"up", "Up"},
+	{"down", "Down"}, {"kick", "Kick"}}
+
+// Every action the manager knows, anything else under /admin doesn't exist.
+var adminActions = map[string]bool{"promote": true, "up": true, "down": true,
+	"kick": true, "demote": true, "lock": true, "unlock": true, "drain": true,
+	"dump": true}
+
+var DumpHTML string = `
+<form action="/admin/dump" method="GET" style="float:right">
 <input type="hidden" name="mount" value="%s" />
-<input type="hidden" name="num" value="%d" />
-<input type="submit" value="Kick" %s />
-</form></td></tr>
+<input type="submit" value="Dump delay (%s)" />
+</form>
 `
 
 
@@ -65,35 +131,229 @@ special cased for metadata and listener listing respectively are not included
 and are handled by different handlers.
 */
 func adminHandler(w http.ResponseWriter, r *http.Request, clientID *ClientID) {
-	HandlerLock.Lock()
 	if r.URL.Path == "/admin" {
-		Body := ""
+		global, modes := Modes()
+		Body := fmt.Sprintf(ModeHTML, "Server", global, modeForms(""))
+		for mount, mode := range modes {
+			Body += fmt.Sprintf(ModeHTML, mount, mode, modeForms(mount))
+		}
+		Body += LockHTML
+
+		HandlerLock.Lock()
 		for mount, clients := range HandlerMounts {
 			MountBody := ""
 			for i, c := range clients {
 				name := c.ClientID.Name
+				actions := queueActions
 				if i == 0 {
 					name = fmt.Sprintf("<b>%s</b>", c.ClientID.Name)
+					actions = liveActions
+				}
+				Actions := ""
+				for _, action := range actions {
+					Actions += fmt.Sprintf(ActionHTML, action[0], mount, c.Serial, action[1])
 				}
-				ClientBody := fmt.Sprintf(ClientHTML, name, c.Metadata, c.ClientID.Agent, mount, i, "")
+				status := HandlerStatus[c]
+				Metadata := status.Metadata
+				if dropped := ClientMetadataDropped(c); dropped > 0 {
+					Metadata += fmt.Sprintf(" <i>(%d updates dropped)</i>", dropped)
+				}
+				ClientBody := fmt.Sprintf(ClientHTML, name, Metadata, c.ClientID.Agent,
+					clientTime(mount, c.ClientID.Name, status), Actions)
 				MountBody = MountBody + ClientBody
 			}
-			Body = Body + fmt.Sprintf(MountHTML, mount, MountBody)
+			Dump := ""
+			if delay, ok := config.Delays[mount]; ok {
+				Dump = fmt.Sprintf(DumpHTML, mount, delay.Duration)
+			}
+			Dump += modeForms(mount)
+			Title := fmt.Sprintf("%s (%s)", mount, MountMode(mount))
+			if dropped := MountMetadataDropped(mount); dropped > 0 {
+				Title += fmt.Sprintf(" - %d metadata updates dropped", dropped)
+			}
+			Body = Body + fmt.Sprintf(MountHTML, Title, Dump, MountBody)
 		}
 		w.Write([]byte(fmt.Sprintf(AdminHTML, Body)))
-	} else if r.URL.Path == "/admin/kick" {
+		HandlerLock.Unlock()
+	} else if r.URL.Path == "/admin/history" || r.URL.Path == "/admin/history.json" {
+		historyHandler(w, r)
+	} else if r.URL.Path == "/admin/clients.json" {
+		clientsHandler(w, r)
+	} else if Action := strings.TrimPrefix(r.URL.Path, "/admin/"); !adminActions[Action] {
+		http.NotFound(w, r)
+	} else {
+		// Everything else is an action on a mount or one of its clients,
+		// the manager takes care of those.
 		MountName := r.URL.Query().Get("mount")
-		Id, err := strconv.Atoi(r.URL.Query().Get("num"))
-		if err == nil {
-			clients, ok := HandlerMounts[MountName]
-			if ok {
-				clients[Id].Conn.Close()
-			}
-		}
+		Id, _ := strconv.ParseUint(r.URL.Query().Get("id"), 10, 64)
+		ClientManager.AdminChan <- &AdminPack{Action: Action, Mount: MountName, Client: Id}
 		w.Header().Set("Location", "/admin")
 		w.WriteHeader(301)
 	}
+}
+
+/*
+clientsHandler lists the clients of every mount as JSON, the live client
+first followed by the queue.
+*/
+func clientsHandler(w http.ResponseWriter, r *http.Request) {
+	type clientInfo struct {
+		Serial   uint64 `json:"id"`
+		Name     string `json:"name"`
+		Agent    string `json:"agent"`
+		Live     bool   `json:"live"`
+		Metadata string `json:"metadata"`
+		Track    *Track `json:"track,omitempty"`
+		// Metadata updates dropped for being sent too fast
+		Dropped uint64 `json:"metadata_dropped"`
+	}
+
+	HandlerLock.Lock()
+	mounts := make(map[string][]clientInfo, len(HandlerMounts))
+	for mount, clients := range HandlerMounts {
+		infos := make([]clientInfo, 0, len(clients))
+		for _, c := range clients {
+			status := HandlerStatus[c]
+			infos = append(infos, clientInfo{Serial: c.Serial,
+				Name: c.ClientID.Name, Agent: c.ClientID.Agent,
+				Live: !status.LiveSince.IsZero(), Metadata: status.Metadata,
+				Track: status.Track, Dropped: ClientMetadataDropped(c)})
+		}
+		mounts[mount] = infos
+	}
 	HandlerLock.Unlock()
+
+	response, _ := json.Marshal(map[string]interface{}{"mounts": mounts})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
+
+/*
+historyHandler shows the metadata history of a mount, either as a page or
+as JSON for /admin/history.json. The query takes the mount, an optional
+time range as from and to and a limit on the amount of entries, the
+newest entries are returned first. Asking for at returns what was playing
+at that time, which leaves out metadata that never went upstream.
+*/
+func historyHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	mount, _ := config.ResolveMount(query.Get("mount"))
+
+	var from, to time.Time
+	limit := 50
+	playing := false
+	if value := query.Get("from"); value != "" {
+		from = parseHistoryTime(value)
+	}
+	if value := query.Get("to"); value != "" {
+		to = parseHistoryTime(value)
+	}
+	if value := query.Get("at"); value != "" {
+		to = parseHistoryTime(value)
+		limit = 1
+		playing = true
+	}
+	if value, err := strconv.Atoi(query.Get("limit")); err == nil && value > 0 {
+		limit = value
+	}
+
+	var entries []HistoryEntry
+	if query.Get("mount") != "" {
+		entries = MountHistory(mount).Between(from, to, limit, playing)
+	}
+
+	if r.URL.Path == "/admin/history.json" {
+		response, _ := json.Marshal(map[string]interface{}{
+			"mount": mount, "entries": entries})
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(response)
+		return
+	}
+
+	Options := ""
+	for _, name := range HistoryMounts() {
+		selected := ""
+		if name == mount {
+			selected = ` selected="selected"`
+		}
+		Options += fmt.Sprintf(`<option%s>%s</option>`, selected, html.EscapeString(name))
+	}
+	Rows := ""
+	for _, entry := range entries {
+		Rows += fmt.Sprintf(HistoryEntryHTML, entry.Time.Local().Format(historyTime),
+			html.EscapeString(entry.User), html.EscapeString(entry.Metadata),
+			html.EscapeString(entry.Original), entry.Sent)
+	}
+	formatted := func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.Format(historyTime)
+	}
+	Body := fmt.Sprintf(HistoryHTML, Options, formatted(from), formatted(to), Rows)
+	w.Write([]byte(fmt.Sprintf(AdminHTML, Body)))
+}
+
+/*
+Parses a time from the history query in local time, the seconds or the
+whole time of day may be left out. A zero time is returned if it can't be
+parsed.
+*/
+func parseHistoryTime(value string) time.Time {
+	for _, layout := range []string{historyTime, "2006-01-02 15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+/*
+Returns the forms for changing the mode of a mount, or of the server if
+the mount is "".
+*/
+func modeForms(mount string) string {
+	forms := ""
+	for _, action := range modeActions {
+		forms += fmt.Sprintf(ActionHTML, action[0], mount, 0, action[1])
+	}
+	return forms
+}
+
+/*
+Returns true if the user of the client already has a source connected to
+the mount, such a user isn't new when the mount is locked.
+*/
+func hasSource(clientID *ClientID) bool {
+	HandlerLock.Lock()
+	defer HandlerLock.Unlock()
+	for _, c := range HandlerMounts[clientID.Mount] {
+		if c.ClientID.Name != "" && strings.EqualFold(c.ClientID.Name, clientID.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Returns how long a client has been live or waiting, together with its
+limit if it has one.
+*/
+func clientTime(mount string, user string, status ClientStatus) string {
+	limits := config.LimitsFor(mount, user)
+	since, limit, state := status.QueuedSince, limits.Wait, "waiting"
+	if !status.LiveSince.IsZero() {
+		since, limit, state = status.LiveSince, limits.Live, "live"
+	}
+	if since.IsZero() {
+		return ""
+	}
+
+	elapsed := time.Since(since) / time.Second * time.Second
+	if limit > 0 {
+		return fmt.Sprintf("%s %s / %s", state, elapsed, limit)
+	}
+	return fmt.Sprintf("%s %s", state, elapsed)
 }
 
 /*
@@ -105,6 +365,9 @@ func mainHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "SOURCE" {
 		/* This is a new icecast source, pass it to the separate handler */
 		makeAuthHandler(sourceHandler, PERM_SOURCE)(w, r)
+	} else if r.Method == "POST" && r.URL.Path == "/admin/metadata" {
+		/* Metadata with separate fields, as JSON */
+		makeAuthHandler(jsonMetadataHandler, PERM_META)(w, r)
 	} else if r.Method == "GET" {
 		path := r.URL.Path
 		lenPath := len(path)
@@ -146,6 +409,12 @@ func metadataHandler(w http.ResponseWriter, r *http.Request,
 	   metadata of inactive users */
 	var meta string
 
+	if _, ok := config.ResolveMount(clientID.Mount); !ok {
+		http.Error(w, "Mount "+clientID.Mount+" doesn't exist on this server.",
+			http.StatusNotFound)
+		return
+	}
+
 	parsed := r.URL.Query()
 
 	meta = parsed.Get("song")
@@ -155,25 +424,23 @@ func metadataHandler(w http.ResponseWriter, r *http.Request,
 		return
 	}
 
-	var charset string
-	if e := parsed.Get("charset"); e != "" {
-		// TODO: Check if user specified encodings are not vulnerable to exploits
-		charset = e
-	} else {
-		charset = "latin1"
-	}
+	// Most sources don't tell us, ParseMetadata guesses in that case
+	charset := parsed.Get("charset")
 
 	log.Printf("\n%s", hex.Dump([]byte(meta)))
 	log.Printf("%s (%s)", meta, charset)
 	// This isn't so much a parser as it is a encoding handler.
 	meta = ParseMetadata(charset, meta)
 
-	// Sending empty metadata is useless, so we don't
-	if meta != "" {
+	// Rewrite it the way the mount wants it, this drops empty metadata as
+	// well since sending that is useless.
+	original := meta
+	if meta, ok := RewriteMetadata(clientID, meta); ok {
 		// And we are done here, send the data we have so far along
-		ClientManager.MetaChan <- &MetaPack{Data: meta, ID: clientID, Seen: false}
+		ClientManager.MetaChan <- &MetaPack{Data: meta, ID: clientID,
+			Original: original}
 	} else {
-		log.Printf("empty metadata")
+		log.Printf("metadata dropped: %s", original)
 	}
 
 	response := []byte("<?xml version=\"1.0\"?>\n<iceresponse><message>Metadata update successful</message><return>1</return></iceresponse>\n")
@@ -182,6 +449,62 @@ func metadataHandler(w http.ResponseWriter, r *http.Request,
 	w.Write(response)
 }
 
+/*
+jsonMetadataHandler takes metadata with separate fields as a JSON object,
+see Track. It is matched to a source the same way as metadata sent to
+metadataHandler, the mount can be given in the object instead of the
+query.
+
+	{"mount": "/main.mp3", "artist": "Artist", "title": "Title",
+	 "album": "Album", "artwork": "http://...", "duration": 215}
+
+The metadata sent upstream is rendered from the fields with the configured
+template, the response tells what it turned into. At least the artist or
+the title has to be given.
+*/
+func jsonMetadataHandler(w http.ResponseWriter, r *http.Request,
+	clientID *ClientID) {
+
+	var request struct {
+		Track
+		Mount string `json:"mount"`
+	}
+	body := http.MaxBytesReader(w, r.Body, 64*1024)
+	if err := json.NewDecoder(body).Decode(&request); err != nil {
+		http.Error(w, "Invalid metadata: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if r.URL.Query().Get("mount") == "" && request.Mount != "" {
+		clientID.Mount, _ = config.ResolveMount(request.Mount)
+	}
+	if _, ok := config.ResolveMount(clientID.Mount); !ok || clientID.Mount == "/" {
+		http.Error(w, "Mount "+clientID.Mount+" doesn't exist on this server.",
+			http.StatusNotFound)
+		return
+	}
+
+	track := request.Track
+	if track.Artist == "" && track.Title == "" {
+		http.Error(w, "Metadata needs an artist or a title.",
+			http.StatusBadRequest)
+		return
+	}
+	original := track.Metadata()
+	meta, ok := RewriteMetadata(clientID, original)
+	if ok {
+		ClientManager.MetaChan <- &MetaPack{Data: meta, ID: clientID,
+			Original: original, Track: &track}
+	} else {
+		log.Printf("metadata dropped: %s", original)
+	}
+
+	response, _ := json.Marshal(map[string]interface{}{
+		"accepted": ok, "metadata": meta})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
+
 /*
 sourceHandler is the handler for icecast source clients. It acknowledges the
 client before sending it over to the icecast manager.
@@ -190,6 +513,23 @@ func sourceHandler(w http.ResponseWriter, r *http.Request, clientID *ClientID) {
 	/* Handler for icecast source requests. This can only be called by
 	   authenticated requests */
 
+	if _, ok := config.ResolveMount(clientID.Mount); !ok {
+		http.Error(w, "Mount "+clientID.Mount+" doesn't exist on this server.",
+			http.StatusNotFound)
+		return
+	}
+	if clientID.Perm < PERM_ADMIN &&
+		!config.AllowedUser(clientID.Mount, clientID.Name) {
+		http.Error(w, "You are not allowed to stream to "+clientID.Mount+".",
+			http.StatusForbidden)
+		return
+	}
+	if mode := MountMode(clientID.Mount); mode != MODE_OPEN && !hasSource(clientID) {
+		http.Error(w, NewLocked(clientID.Mount, mode).Error(),
+			http.StatusServiceUnavailable)
+		return
+	}
+
 	// Icecast clients expect a 200 OK response before sending data.
 	w.WriteHeader(http.StatusOK)
 	// Make sure to send the extra newline to signify end of headers
@@ -235,5 +575,35 @@ func Initialize() {
 		Handler:      mux,
 		ReadTimeout:  time.Second * 10,
 		WriteTimeout: time.Second * 5}
-	server.ListenAndServe()
+
+	// We keep the listener around so we can stop serving when drained
+	listener, err := net.Listen("tcp", config.ServerAddress)
+	if err != nil {
+		log.Printf("listen failed: %s", err)
+		return
+	}
+	listenerLock.Lock()
+	serverListener = listener
+	listenerLock.Unlock()
+
+	// Playout software can send metadata without HTTP as well
+	StartInputs()
+	defer StopInputs()
+
+	server.Serve(listener)
+}
+
+// The listener of the HTTP server, nil until it's listening.
+var serverListener net.Listener
+var listenerLock sync.Mutex
+
+/*
+Stops accepting HTTP requests, which makes Initialize return.
+*/
+func Shutdown() {
+	listenerLock.Lock()
+	defer listenerLock.Unlock()
+	if serverListener != nil {
+		serverListener.Close()
+	}
 }
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"github.com/Wessie/icecast-proxy-go/audio"
 	"github.com/Wessie/icecast-proxy-go/config"
 	"github.com/Wessie/icecast-proxy-go/shout"
 	"log"
@@ -10,10 +11,12 @@ import (
 
 var ClientManager *Manager
 var metaStoreTicker <-chan time.Time
+var mountTicker <-chan time.Time
 var logger *log.Logger
 
 func init() {
 	metaStoreTicker = time.Tick(time.Second * 5)
+	mountTicker = time.Tick(time.Millisecond * 250)
 
 	logger = log.New(os.Stdout, "", log.LstdFlags|log.Lmicroseconds)
 
@@ -41,6 +44,21 @@ func (self *Manager) ProcessClients() {
 	dataChan := make(chan *DataPack, 1024)
 	errChan := make(chan *ErrPack, 512)
 
+	// Mounts with a fallback exist from the start, they play the
+	// fallback until the first client connects.
+	for _, fallbacks := range []map[string]string{config.Fallbacks,
+		config.FallbackMounts} {
+		for name := range fallbacks {
+			if _, ok := self.Mounts[name]; ok {
+				continue
+			}
+			logger.Printf(":new mount: %s", name)
+			mount := NewMount(name, FormatFromMount(name), self.PlayChan)
+			self.Mounts[name] = mount
+			self.UnsetLiveClient(mount)
+		}
+	}
+
 	for {
 		select {
 		case data := <-dataChan:
@@ -56,6 +74,16 @@ func (self *Manager) ProcessClients() {
 			if mount.Active == data.Client.ClientID {
 				// Active mount, and data HANDLE IT!
 				mount.HandleData(data)
+
+				// Mounts falling back to this one send it as well
+				for _, carrier := range self.Mounts {
+					if carrier.Carrying == mount.Mount {
+						carrier.HandleData(data)
+					}
+				}
+
+				// And make sure we aren't broadcasting dead air
+				self.CheckSilence(mount, data.Client)
 			}
 
 			// It's an non-active client otherwise so discard the data silently
@@ -85,123 +113,84 @@ func (self *Manager) ProcessClients() {
 				// earlier than this since it could mean there are errors
 				// when pre-processing it.
 				HandleClientConnect(client)
+				self.QueueChanged(self.Mounts[client.ClientID.Mount])
 				// We are done preparing, start reading.
 				go ReadInto(client, dataChan, errChan)
 			}
 		case mount := <-self.MountCollector:
 			// The mount is 'empty' we have to do some checks and clean up
 			// if neccesary
-			logger.Printf(":collecting mount: %s", mount.Mount)
-
-			if mount.Clients.Length > 0 {
-				// The mount got a new client while waiting, ignore it.
-				logger.Printf(":collection aborted: %s", mount.Mount)
+			self.CollectMount(mount)
+		case play := <-self.PlayChan:
+			mount, ok := self.Mounts[play.Player.Mount.Mount]
+			if !ok || mount != play.Player.Mount {
+				// The mount has been collected since.
 				continue
 			}
-			// no new clients so we have to clean it up.
 
-			// Close our connection to the server
-			logger.Printf(":icecast disconnect: %s", mount.Mount)
-			err := mount.Shout.Close()
-			if err != nil {
-				// Log the error but don't do anything with it other than that
-				// TODO: Add logging
+			if mount.HandlePlay(play) {
+				// Mounts falling back to this one send it as well
+				for _, carrier := range self.Mounts {
+					if carrier.Carrying == mount.Mount {
+						carrier.CarryPlay(play)
+					}
+				}
 			}
-
-			// Delete it from our mapping
-			delete(self.Mounts, mount.Mount)
-
-			// Yay garbage collection! The C bindings need some
-			// extra help though, the rest will be done by the
-			// garbage collector
-			DestroyMount(mount)
-			logger.Printf(":collection finished: %s", mount.Mount)
 		case meta := <-self.MetaChan:
-			// Receiving metadata is slightly complicated because our
-			// only method to knowing if something is for a specific
-			// client is by comparing collected variables that we hope
-			// generate a unique ID for the client. The ClientID.Hash
-			// method is here for this specific cause.
-
-			// Pre compute, since we are bound to use it more than once
-			// in the rest of this block.
-			meta_hash := meta.ID.Hash()
-
-			logger.Printf(":metadata:%x: %s", meta_hash, meta.Data)
-
-			mount, ok := self.Mounts[meta.ID.Mount]
-
-			if !ok {
-				// There is no mountpoint known with the name requested by
-				// the one sending the metadata. We save it temporarily.
-				logger.Printf(":metadata stored: %s", meta.Data)
-				self.metaStore[meta_hash] = meta.Data
+			if meta.Live && !self.ResolveLiveMetadata(meta) {
 				continue
 			}
-
-			// Pre compute, since we are bound to use it more than once
-			// in the rest of this block.
-			active_hash := mount.Active.Hash()
-
-			// We have a mountpoint with the name, but first have to check
-			// if the active client is sending data or just one of the other
-			// connected ones is.
-
-			if active_hash != meta_hash {
-				// This means it's one of the other clients sending metadata
-				// Save the metadata for them for when the Active client leaves
-				if client, ok := mount.Clients.GetByHash(meta_hash); ok {
-					client.Metadata = meta.Data
-
-					// Don't forget to call our handler
-					HandleMetadata(client, meta.Data)
-				} else {
-					// We don't seem to have an actual client connected with
-					// this specific identifier... Discard?
-					logger.Printf(":metadata discarded: %s", meta.Data)
-					// TODO: Check if discarding isn't needed...
-				}
+			// Sources sending metadata too fast only get their latest
+			// through, once the limit allows it.
+			if !meta.Resent && !self.limiter.Allow(meta, time.Now()) {
 				continue
 			}
+			self.ProcessMetadata(meta)
+		case now := <-mountTicker:
+			for _, mount := range self.Mounts {
+				if mount.Delay != nil {
+					mount.ReleaseDelayed(now)
+				}
+				mount.ReleaseHeld(now)
+				mount.ReleaseMetadata(now)
 
-			// The active client is sending metadata, we don't have to do much
-			// special for this case, just send it along to icecast and save the
-			// metadata in the Client struct.
+				self.CheckGrace(mount, now)
+				self.CheckLimits(mount, now)
+				self.CheckSchedule(mount, now)
 
-			client, ok := mount.Clients.GetByHash(active_hash)
+				// Keep the upstream busy if nothing else does
+				mount.FillSilence(now)
 
-			if !ok {
-				// We... don't seem to have the active client?
-				// Lets drop the packet and just continue on!
-				continue
+				if mount.Jingle != nil && mount.Active != nil {
+					interval := config.Jingles[mount.Mount].Interval
+					if interval > 0 && now.Sub(mount.lastJingle) >= interval {
+						mount.StartJingle()
+					}
+				}
+
+				if !mount.emptySince.IsZero() &&
+					now.Sub(mount.emptySince) >= config.SilenceLinger {
+					mount.emptySince = time.Time{}
+					self.CollectMount(mount)
+				}
 			}
 
-			// Set our metadata, this is mostly done for info gathering by other
-			// code. We don't actually use this value in the client server code.
-			client.Metadata = meta.Data
+			self.UpdateCarriers()
+			self.CheckDrain()
 
-			// And send the metadata, we are ignoring errors here
-			// TODO: Check if ignoring errors could lead to problems.
-			if meta.Seen {
-				if err := mount.Shout.SendMetadata(meta.Data); err != nil {
-					logger.Printf(":metadata failed: %s", err)
+			for _, meta := range self.limiter.Release(now) {
+				self.ProcessMetadata(meta)
+			}
+		case admin := <-self.AdminChan:
+			self.HandleAdmin(admin)
+		case now := <-metaStoreTicker:
+			// We don't want old data, the client it was for isn't coming
+			for hash, stored := range self.metaStore {
+				if now.Sub(stored.Stored) >= config.MetadataTTL {
+					delete(self.metaStore, hash)
 				}
-			} else {
-				go func() {
-					time.Sleep(time.Second)
-					meta.Seen = true
-					self.MetaChan <- meta
-				}()
-
-				// Call our handler for metadata, we do it here since we
-				// already verified the metadata is fine for sending, there
-				// is no need to wait out the extra second.
-				HandleMetadata(client, meta.Data)
 			}
-		case <-metaStoreTicker:
-			// We store metadata for unknown mounts in this mapping.
-			// We recreate it every few seconds since we don't want old data
-			self.metaStore = make(map[ClientHash]string, 5)
+			self.limiter.Prune(now)
 		}
 	}
 }
@@ -215,6 +204,315 @@ between the check and the actual send it will discard the current data
 package and rely on the next call to this function to reconnect.
 */
 func (self *Mount) HandleData(data *DataPack) {
+	self.received += uint64(len(data.Data))
+
+	if self.Delay != nil {
+		now := time.Now()
+		self.Delay.entries = append(self.Delay.entries,
+			delayed{at: now, data: data})
+		self.ReleaseDelayed(now)
+		return
+	}
+	self.sendLive(data)
+}
+
+/*
+Sends live data that is done being delayed, unless it has to wait for a
+jingle to finish.
+*/
+func (self *Mount) sendLive(data *DataPack) {
+	if self.jingling || len(self.held) > 0 {
+		// The client has to wait for the jingle to finish, and for the
+		// data held back before to go out first.
+		self.held = append(self.held, delayed{at: time.Now(), data: data})
+		return
+	}
+	self.forwardLive(data)
+}
+
+/*
+Sends live data upstream, with the headers of its stream if the upstream
+needs them.
+*/
+func (self *Mount) forwardLive(data *DataPack) {
+	if self.resync && data.Headers != nil && !audio.IsOggBOS(data.Data) {
+		// The stream of the client started before this point, the
+		// upstream needs the headers to make sense of it.
+		self.Send(data.Headers)
+	}
+	self.Send(data.Data)
+
+	self.sent += uint64(len(data.Data))
+	self.ReleaseMetadata(time.Now())
+}
+
+/*
+Sends audio read by one of the players of the mount to the icecast server,
+data of players that aren't supposed to be playing is dropped. Returns true
+if the audio is the fallback of the mount standing in for a live client,
+which mounts carrying this one send as well.
+*/
+func (self *Mount) HandlePlay(play *PlayPack) bool {
+	switch {
+	case play.Player == self.Jingle && self.jingling:
+		if play.Done {
+			self.FinishJingle()
+			return false
+		}
+	case play.Player == self.Fallback && !self.jingling && self.Carrying == "" &&
+		(self.Active == nil || self.Delay != nil && self.Delay.covering):
+		if play.Done {
+			logger.Printf(":fallback finished: %s", self.Mount)
+			return false
+		}
+	default:
+		// Leftovers of a player that has been stopped since.
+		return false
+	}
+
+	self.Send(play.Data)
+
+	if play.Title != "" && play.Player == self.Fallback {
+		logger.Printf(":fallback track:%s: %s", self.Mount, play.Title)
+		// Ogg files carry their own comments, which we shouldn't replace
+		// with the ones of whoever was live before.
+		if self.tagger != nil {
+			self.tagger.SetTags(nil)
+			self.recordMetadata(HistoryEntry{Metadata: play.Title},
+				self.Shout.Connected())
+		} else {
+			self.sendMetadataNow(HistoryEntry{Metadata: play.Title})
+		}
+	}
+	return play.Player == self.Fallback && self.Active == nil
+}
+
+/*
+Starts a jingle on the mount, the live client is held back until it is
+done. Nothing happens if the mount has no jingles or one is playing.
+*/
+func (self *Mount) StartJingle() {
+	if self.Jingle == nil || self.jingling {
+		return
+	}
+	logger.Printf(":jingle start: %s", self.Mount)
+
+	self.jingling = true
+	self.lastJingle = time.Now()
+	// The goroutine of the last jingle might not have exited yet after
+	// telling us it was done, which would make Start do nothing.
+	self.Jingle.Stop()
+	self.Jingle.Start(self.plays)
+}
+
+/*
+Starts the fallback of the mount if it has one and there is no live client.
+*/
+func (self *Mount) StartFallback() {
+	if self.Fallback == nil || self.Active != nil || self.Carrying != "" {
+		return
+	}
+	logger.Printf(":fallback start: %s", self.Mount)
+	self.Fallback.Start(self.plays)
+}
+
+/*
+Stops the fallback of the mount if it is playing.
+*/
+func (self *Mount) StopFallback() {
+	if self.Fallback != nil && self.Fallback.Running() {
+		logger.Printf(":fallback stop: %s", self.Mount)
+		self.Fallback.Stop()
+	}
+}
+
+/*
+Prepares the upstream for the audio of a new live client. This stops the
+fallback and plays a jingle if the mount has one.
+*/
+func (self *Mount) handover() {
+	self.StopFallback()
+
+	// The client has been sending data for a while already
+	self.resync = true
+
+	// Anything held back belongs to the old client, and the new one gets
+	// introduced with a jingle.
+	for _, entry := range self.held {
+		self.skipLive(entry.data)
+	}
+	self.held = nil
+	self.StartJingle()
+}
+
+/*
+Ends the jingle, the live data that was held back in the meantime follows
+at the rate it came in, see ReleaseHeld.
+*/
+func (self *Mount) FinishJingle() {
+	logger.Printf(":jingle finished: %s", self.Mount)
+
+	self.jingling = false
+	// The jingle was a stream of its own, so the held data needs the
+	// headers of the client again.
+	self.resync = true
+
+	self.heldLag = 0
+	if len(self.held) > 0 {
+		self.heldLag = time.Since(self.held[0].at)
+	}
+	self.ReleaseHeld(time.Now())
+}
+
+/*
+Sends the live data held back behind a jingle once it is as late as the
+jingle made it. Sending it all at once would overrun the buffers of the
+listeners, so the client stays behind by the length of the jingle until it
+stalls for that long.
+*/
+func (self *Mount) ReleaseHeld(now time.Time) {
+	if self.jingling {
+		return
+	}
+	for len(self.held) > 0 && now.Sub(self.held[0].at) >= self.heldLag {
+		data := self.held[0].data
+		self.held[0] = delayed{}
+		self.held = self.held[1:]
+		self.forwardLive(data)
+	}
+}
+
+/*
+Sends frame aligned audio data to the icecast server. Any silence that
+is being generated is stopped first.
+*/
+func (self *Mount) Send(data []byte) {
+	self.silence.Observe(data)
+
+	if self.filling {
+		self.filling = false
+		self.write(self.silence.Finish())
+	}
+
+	self.lastSend = time.Now()
+	self.resync = false
+	self.write(data)
+}
+
+/*
+Sends silence upstream when nothing else has been sent for the configured
+interval, this keeps the connection and with it the listeners around when
+there is a gap between clients or a client stalls.
+*/
+func (self *Mount) FillSilence(now time.Time) {
+	if !self.filling {
+		if config.SilenceFill == 0 || self.lastSend.IsZero() ||
+			now.Sub(self.lastSend) < config.SilenceFill {
+			return
+		}
+		self.startFilling(now)
+	}
+
+	// Stay a little bit ahead of real time, just like the players.
+	data, duration := self.silence.Generate(now.Add(playerLead).Sub(self.fillClock))
+	if data == nil {
+		return
+	}
+	self.write(data)
+	self.fillClock = self.fillClock.Add(duration)
+}
+
+/*
+Sends the metadata of the history entry to the icecast server right away
+and records it in the history of the mount.
+*/
+func (self *Mount) sendMetadataNow(entry HistoryEntry) {
+	sent := true
+	switch {
+	case self.tagger != nil:
+		// The comments change with the next page that is sent, or with the
+		// headers the tagger starts over with once we are connected.
+		self.tagger.SetTags(OggTags(entry.Metadata))
+		if !self.Shout.Connected() {
+			logger.Printf(":metadata queued:%s: %s", self.Mount, entry.Metadata)
+			sent = false
+		}
+	case !self.Shout.Connected():
+		logger.Printf(":metadata queued:%s: %s", self.Mount, entry.Metadata)
+		sent = false
+	default:
+		if err := self.Shout.SendMetadata(entry.Metadata); err != nil {
+			logger.Printf(":metadata failed: %s", err)
+			sent = false
+		}
+	}
+	self.recordMetadata(entry, sent)
+}
+
+/*
+Records metadata that went to the icecast server, or will once we are
+connected if sent is false, in the history of the mount. The handlers are
+told about it once it is sent.
+*/
+func (self *Mount) recordMetadata(entry HistoryEntry, sent bool) {
+	entry.Time = time.Now()
+	entry.Sent = sent
+	MountHistory(self.Mount).Add(entry)
+
+	// Icecast forgets the metadata when we disconnect, so we keep it
+	// around to send it again, see replayMetadata.
+	self.metadata = entry
+	self.metadataSent = sent
+	if sent {
+		HandleMetadataSent(self.Mount, entry)
+	}
+}
+
+/*
+Sends the latest metadata of the mount to the icecast server again, this
+is done after every connect. Ogg streams carry their metadata themselves,
+the tagger puts it in the headers it starts the stream over with.
+*/
+func (self *Mount) replayMetadata() {
+	if self.metadata.Metadata == "" {
+		return
+	}
+	if self.tagger == nil {
+		if err := self.Shout.SendMetadata(self.metadata.Metadata); err != nil {
+			logger.Printf(":metadata failed: %s", err)
+			return
+		}
+	}
+	logger.Printf(":metadata replayed:%s: %s", self.Mount, self.metadata.Metadata)
+
+	// Metadata that was queued is only now going out
+	if !self.metadataSent {
+		self.metadataSent = true
+		MountHistory(self.Mount).MarkSent(self.metadata)
+		self.metadata.Sent = true
+		HandleMetadataSent(self.Mount, self.metadata)
+	}
+}
+
+/*
+Marks the mount as sending silence from now on, which continues until
+anything else is sent. FillSilence does the actual sending.
+*/
+func (self *Mount) startFilling(now time.Time) {
+	logger.Printf(":silence fill: %s", self.Mount)
+	self.filling = true
+	self.resync = true
+	self.fillClock = now
+}
+
+/*
+Writes data to the icecast server, connecting first if needed. See
+HandleData for the details.
+*/
+func (self *Mount) write(data []byte) {
+	if len(data) == 0 {
+		return
+	}
 
 	// First check if we are connected at all
 	if !self.Shout.Connected() {
@@ -226,12 +524,26 @@ func (self *Mount) HandleData(data *DataPack) {
 		if err != nil {
 			logger.Printf(":icecast error: %s (error: %s)", self.Mount, err.Error())
 			// Error occured while connecting, we ditch the data and retry
-			// on the next package
+			// on the next package. The tagger never saw the data, so the
+			// headers of any stream starting in it have to come again.
+			self.resync = true
 			return
 		}
+		// The icecast server needs the headers of the stream again, with
+		// the tags we had applied.
+		if self.tagger != nil && !self.tagger.Reset() {
+			self.resync = true
+		}
+		self.replayMetadata()
+	}
+
+	// Only tag data that is going out, the tagger thinks the tags are
+	// applied once it has seen it.
+	if self.tagger != nil {
+		data = self.tagger.Process(data)
 	}
 
-	err := self.Shout.Send(data.Data)
+	err := self.Shout.Send(data)
 
 	if err != nil {
 		// An error occured while sending data, we ditch the data and retry
@@ -274,6 +586,18 @@ func (self *Manager) SwapLiveClient(mount *Mount, client *Client) {
 	}
 
 	mount.Active = client.ClientID
+	// Silence and time limits from an earlier live period shouldn't count
+	client.resetDeadAir()
+	client.LiveSince = time.Now()
+	client.QueuedSince = time.Time{}
+	client.Warned = false
+	if old_live_client != nil {
+		old_live_client.LiveSince = time.Time{}
+	}
+
+	// The upstream only switches once the audio of the old client that
+	// might still be delayed is gone.
+	mount.WhenSent(mount.handover)
 
 	// Call the handlers, the order doesn't really matter
 	// Lets first make sure we aren't sending a nil pointer.
@@ -282,39 +606,247 @@ func (self *Manager) SwapLiveClient(mount *Mount, client *Client) {
 	}
 
 	HandleClientLive(client)
+	self.ResyncCarriers(mount)
+	self.UpdateCarriers()
 
 	// We found a new client we can switch to. Lets continue the
 	// work needed, such as saved metadata.
-	self.MetaChan <- &MetaPack{client.Metadata,
-		client.ClientID,
-		false}
+	self.MetaChan <- &MetaPack{Data: client.Metadata,
+		ID: client.ClientID, Track: client.Track, Resent: true}
+}
+
+/*
+Removes the live client from the mount without putting anyone else live.
+The fallback of the mount is started if it has one.
+*/
+func (self *Manager) UnsetLiveClient(mount *Mount) {
+	old_live_client, ok := mount.Clients.GetByID(mount.Active)
+
+	mount.Active = nil
+
+	if ok {
+		old_live_client.LiveSince = time.Time{}
+		HandleClientUnlive(old_live_client)
+	}
+
+	mount.WhenSent(mount.StartFallback)
+	self.ResyncCarriers(mount)
+	self.UpdateCarriers()
 }
 
 /*
 Switches to the next available client, this uses the Mount.ClientQueue
-for determining what the next client shall be.
+for determining what the next client shall be, the one waiting with the
+highest priority. The mount is left without
+a live client if the queue is empty.
 */
 func (self *Manager) NextLiveClient(mount *Mount, client *Client) {
-client_loop:
 	for {
-		select {
-		case new_id := <-mount.ClientQueue:
-			new_client, ok := mount.Clients.GetByID(new_id)
-			if !ok || new_client.ClientID != new_id {
-				// We seem to have hit an old client. Get rid of it.
-				continue
+		entry, ok := mount.ClientQueue.Pop()
+		if !ok {
+			if client == nil || mount.Active == client.ClientID {
+				self.UnsetLiveClient(mount)
 			}
+			return
+		}
+
+		new_client, ok := mount.Clients.GetByID(entry.ID)
+		if !ok || new_client.ClientID != entry.ID || new_client.Kicked {
+			// We seem to have hit an old client. Get rid of it.
+			continue
+		}
+
+		// Swap the clients out.
+		self.SwapLiveClient(mount, new_client)
+		return
+	}
+}
+
+/*
+Puts the live client back into the queue and switches to the next client
+in it. Nothing happens if there is no other client waiting.
+*/
+func (self *Manager) DemoteLiveClient(mount *Mount, client *Client) {
+	if !self.HasWaitingClient(mount) {
+		return
+	}
+
+	logger.Printf(":demote client:%s: %s", mount.Mount, client.String())
+
+	// The client is queued after picking the next one, or its priority
+	// would put it right back.
+	self.NextLiveClient(mount, client)
+	mount.ClientQueue.Push(client.ClientID, client.Priority)
+	// It gets a fresh look at its audio once it is back
+	client.resetDeadAir()
+	self.QueueChanged(mount)
+}
+
+/*
+Returns true if a client that is still connected waits in the queue of the
+mount. Entries of clients that are gone or kicked are removed from the
+front of the queue on the way, so the next call to NextLiveClient picks
+that client.
+*/
+func (self *Manager) HasWaitingClient(mount *Mount) bool {
+	for {
+		entry, ok := mount.ClientQueue.Peek()
+		if !ok {
+			return false
+		}
+		if client, ok := mount.Clients.GetByID(entry.ID); ok &&
+			client.ClientID == entry.ID && !client.Kicked {
+			return true
+		}
+		mount.ClientQueue.Pop()
+	}
+}
+
+/*
+Returns an older connection of the same user to the mount, which we
+assume is dead if the user connects again.
+*/
+func (self *Manager) StaleClient(mount *Mount, client *Client) (*Client, bool) {
+	if client.ClientID.Name == "" {
+		return nil, false
+	}
+	old, ok := mount.Clients.GetOtherByName(client.ClientID.Name, client)
+	if !ok || old.Kicked {
+		return nil, false
+	}
+	return old, true
+}
+
+/*
+Gives the live status or queue position of a client to a new connection
+of the same user and closes the old connection. The metadata of the old
+connection is kept unless the new one has its own.
+*/
+func (self *Manager) ReplaceClient(mount *Mount, old *Client, client *Client) {
+	logger.Printf(":replace client:%s: %s -> %s", mount.Mount,
+		old.String(), client.String())
 
-			// Swap the clients out.
-			self.SwapLiveClient(mount, new_client)
+	if client.Metadata == "" {
+		client.Metadata = old.Metadata
+	}
+
+	if mount.Active == old.ClientID {
+		mount.Active = client.ClientID
+		client.DeadAir = old.DeadAir
+		client.LiveSince, client.Warned = old.LiveSince, old.Warned
+		// The new connection starts a new stream
+		mount.WhenSent(func() { mount.resync = true })
+
+		HandleClientUnlive(old)
+		HandleClientLive(client)
+		self.ResyncCarriers(mount)
+	} else if !mount.ClientQueue.Replace(old.ClientID, client.ClientID) {
+		mount.ClientQueue.Push(client.ClientID, client.Priority)
+	}
+
+	// The reader of the old connection notices and has it removed, it
+	// shouldn't get its slot held like a client that dropped.
+	old.Kicked = true
+	old.Conn.Close()
+}
 
-			break client_loop
-		default:
-			break client_loop
+/*
+Enforces the time limits of the clients on the mount. The live client is
+warned before its time is up and demoted once it is, as long as someone is
+waiting. Clients that waited in the queue for too long are disconnected.
+*/
+func (self *Manager) CheckLimits(mount *Mount, now time.Time) {
+	if active, ok := mount.Clients.GetByID(mount.Active); ok {
+		limits := config.LimitsFor(mount.Mount, active.ClientID.Name)
+		live := now.Sub(active.LiveSince)
+		if limits.Live > 0 && !active.Warned && limits.Warning > 0 &&
+			live >= limits.Live-limits.Warning {
+			active.Warned = true
+			HandleLiveWarning(active, limits.Live-live)
+		}
+		if limits.Live > 0 && live >= limits.Live && self.HasWaitingClient(mount) {
+			logger.Printf(":live limit:%s: %s", mount.Mount, active.String())
+			self.DemoteLiveClient(mount, active)
+		}
+	}
+
+	for _, entry := range mount.ClientQueue.Entries() {
+		client, ok := mount.Clients.GetByID(entry.ID)
+		if !ok || client.Kicked {
+			continue
+		}
+		limits := config.LimitsFor(mount.Mount, client.ClientID.Name)
+		if limits.Wait > 0 && now.Sub(entry.Since) >= limits.Wait {
+			logger.Printf(":wait limit:%s: %s", mount.Mount, client.String())
+			// Removed by its reader like any other client that went away
+			client.Kicked = true
+			client.Conn.Close()
 		}
 	}
 }
 
+/*
+Holds the slot of the live client that lost its connection, the mount
+plays its fallback or silence until the client comes back or the grace
+period is over.
+*/
+func (self *Manager) HoldLiveClient(mount *Mount, client *Client) {
+	logger.Printf(":grace hold:%s: %s", mount.Mount, client.String())
+
+	mount.reserved = client.ClientID.Hash()
+	mount.reservedUntil = time.Now().Add(config.ReconnectGrace)
+	mount.reservedMeta = client.Metadata
+	self.UnsetLiveClient(mount)
+
+	if mount.Fallback == nil && !mount.filling {
+		mount.startFilling(time.Now())
+	}
+}
+
+/*
+Gives up the held slot of the mount once the grace period is over, the
+next client in the queue goes live instead.
+*/
+func (self *Manager) CheckGrace(mount *Mount, now time.Time) {
+	if mount.reserved == 0 || now.Before(mount.reservedUntil) {
+		return
+	}
+	logger.Printf(":grace expired: %s", mount.Mount)
+
+	mount.reserved = 0
+	mount.reservedMeta = ""
+	if mount.Active == nil {
+		self.NextLiveClient(mount, nil)
+	}
+	self.CollectIfEmpty(mount)
+}
+
+/*
+Checks if the live client has been sending silence for longer than the
+configured duration. The dead air handler is called when it has, and the
+client is demoted if the configuration asks for it.
+*/
+func (self *Manager) CheckSilence(mount *Mount, client *Client) {
+	if client.Meter == nil {
+		return
+	}
+
+	silence := client.Meter.SilentFor()
+	if silence < config.SilenceDuration {
+		client.DeadAir = false
+		return
+	}
+
+	if !client.DeadAir {
+		client.DeadAir = true
+		HandleDeadAir(client, silence)
+	}
+
+	if config.SilenceDemote {
+		self.DemoteLiveClient(mount, client)
+	}
+}
+
 /* Removes a client from the mount point and prepares it for
 deletion.
 
@@ -330,9 +862,15 @@ func (self *Manager) RemoveClient(client *Client) {
 		panic("Unexisting mountpoint")
 	}
 
-	if mount.Active == client.ClientID {
+	if mount.Active == client.ClientID && config.ReconnectGrace > 0 &&
+		!client.Kicked {
+		// It might just be a short hiccup, keep the slot free for it
+		self.HoldLiveClient(mount, client)
+	} else if mount.Active == client.ClientID {
 		// Put the next available client live
 		self.NextLiveClient(mount, client)
+	} else {
+		mount.ClientQueue.Remove(client.ClientID)
 	}
 
 	// Remove it from the mount map.
@@ -341,12 +879,39 @@ func (self *Manager) RemoveClient(client *Client) {
 	// We have to close the connection ourself since we Hijacked it
 	client.Conn.Close()
 
+	// The decoder goroutine of the meter is waiting for more data
+	if client.Meter != nil {
+		client.Meter.Close()
+	}
+
 	// This currently is the most logical place to call this since we can
 	// be sure the connection is already closed at this point, and thus avoid
 	// some potential problems in the handlers.
 	HandleClientDisconnect(client)
+	forgetDroppedMetadata(client)
+	// Another connection of the same source might have taken over, the
+	// metadata held back is its metadata then.
+	if _, ok := mount.Clients.GetByHash(client.ClientID.Hash()); !ok {
+		self.limiter.Forget(client.ClientID.Hash())
+	}
+
+	self.CollectIfEmpty(mount)
+}
 
-	if mount.Clients.Length == 0 {
+/*
+Gets rid of the mount if it has no clients and nothing else to play. A
+mount that has its slot held for a client is kept.
+*/
+func (self *Manager) CollectIfEmpty(mount *Mount) {
+	_, chained := config.FallbackMounts[mount.Mount]
+	if mount.Clients.Length == 0 && mount.Fallback == nil && !chained &&
+		mount.reserved == 0 {
+		if config.SilenceFill > 0 && config.SilenceLinger > 0 {
+			// Keep the upstream alive with silence for a while, the next
+			// client might be about to connect.
+			mount.emptySince = time.Now()
+			return
+		}
 		// Register the mount for a collection, we don't collect it here
 		// right away because it's common for two sources to overlap or
 		// swap each other out with a very small delay. This gives it a
@@ -355,6 +920,156 @@ func (self *Manager) RemoveClient(client *Client) {
 	}
 }
 
+/*
+Handles an action requested from the admin interface. Actions for mounts
+or clients that don't exist (anymore) are ignored.
+*/
+func (self *Manager) HandleAdmin(admin *AdminPack) {
+	// The admin might use an alias, mounts go by their own name
+	if admin.Mount != "" {
+		admin.Mount, _ = config.ResolveMount(admin.Mount)
+	}
+
+	// Modes can be set on mounts that don't exist yet, and globally
+	// with an empty mount name.
+	switch admin.Action {
+	case "lock", "unlock", "drain":
+		mode := map[string]Mode{"lock": MODE_LOCKED, "unlock": MODE_OPEN,
+			"drain": MODE_DRAIN}[admin.Action]
+		logger.Printf(":admin mode:%s: %s", admin.Mount, mode)
+		SetMode(admin.Mount, mode)
+		return
+	}
+
+	mount, ok := self.Mounts[admin.Mount]
+	if !ok {
+		return
+	}
+
+	if admin.Action == "dump" {
+		mount.DumpDelay(time.Now())
+		return
+	}
+
+	client, ok := mount.Clients.GetBySerial(admin.Client)
+	if !ok {
+		return
+	}
+	logger.Printf(":admin %s:%s: %s", admin.Action, mount.Mount, client.String())
+
+	switch admin.Action {
+	case "promote":
+		self.PromoteClient(mount, client)
+	case "demote":
+		if mount.Active == client.ClientID {
+			self.DemoteLiveClient(mount, client)
+		}
+	case "up":
+		mount.ClientQueue.Move(client.ClientID, 1)
+	case "down":
+		mount.ClientQueue.Move(client.ClientID, -1)
+	case "kick":
+		client.Kicked = true
+		// The reader of the client notices and has it removed the same
+		// way as any other client that went away.
+		client.Conn.Close()
+		return
+	default:
+		logger.Printf(":admin unknown:%s: %s", admin.Mount, admin.Action)
+		return
+	}
+	self.QueueChanged(mount)
+}
+
+/*
+Lets the handlers know about the order of the clients on the mount, the
+live client first followed by the queue.
+*/
+func (self *Manager) QueueChanged(mount *Mount) {
+	order := make([]*Client, 0, mount.ClientQueue.Len()+1)
+	if client, ok := mount.Clients.GetByID(mount.Active); ok {
+		order = append(order, client)
+	}
+	for _, entry := range mount.ClientQueue.Entries() {
+		if client, ok := mount.Clients.GetByID(entry.ID); ok {
+			client.QueuedSince = entry.Since
+			order = append(order, client)
+		}
+	}
+	HandleQueueChange(mount.Mount, order)
+}
+
+/*
+Makes a client live right away, taking it out of the queue if it was
+waiting. The client that was live goes back into the queue in front of
+the others with its priority.
+*/
+func (self *Manager) PromoteClient(mount *Mount, client *Client) {
+	if mount.Active == client.ClientID {
+		return
+	}
+	logger.Printf(":promote client:%s: %s", mount.Mount, client.String())
+
+	mount.ClientQueue.Remove(client.ClientID)
+	old, ok := mount.Clients.GetByID(mount.Active)
+	self.SwapLiveClient(mount, client)
+	if ok {
+		mount.ClientQueue.PushFront(old.ClientID, old.Priority)
+	}
+	self.QueueChanged(mount)
+}
+
+/*
+Returns true if the client should take over from the live client of the
+mount right away, see config.PreemptPriority.
+*/
+func (self *Manager) Preempts(mount *Mount, client *Client) bool {
+	if config.PreemptPriority == 0 || client.Priority < config.PreemptPriority {
+		return false
+	}
+	active, ok := mount.Clients.GetByID(mount.Active)
+	return ok && active.Priority < client.Priority
+}
+
+/*
+Cleans up a mount without clients, closing the connection to the icecast
+server. Mounts that got a new client in the meantime are left alone.
+*/
+func (self *Manager) CollectMount(mount *Mount) {
+	logger.Printf(":collecting mount: %s", mount.Mount)
+
+	if mount.Clients.Length > 0 {
+		// The mount got a new client while waiting, ignore it.
+		logger.Printf(":collection aborted: %s", mount.Mount)
+		return
+	}
+
+	if mount.Delay != nil && len(mount.Delay.entries) > 0 {
+		// The last client is still going out, try again once the mount
+		// ticker comes around.
+		mount.emptySince = time.Now()
+		return
+	}
+	// no new clients so we have to clean it up.
+
+	// Close our connection to the server
+	logger.Printf(":icecast disconnect: %s", mount.Mount)
+	err := mount.Shout.Close()
+	if err != nil {
+		// Log the error but don't do anything with it other than that
+		// TODO: Add logging
+	}
+
+	// Delete it from our mapping
+	delete(self.Mounts, mount.Mount)
+
+	// Yay garbage collection! The C bindings need some
+	// extra help though, the rest will be done by the
+	// garbage collector
+	DestroyMount(mount)
+	logger.Printf(":collection finished: %s", mount.Mount)
+}
+
 /* Adds a client to the respective mount point, if no mount
 point with the given name currently exist a new one is created */
 func (self *Manager) AddClient(client *Client) (err error) {
@@ -377,26 +1092,6 @@ func (self *Manager) AddClient(client *Client) (err error) {
 	if !ok {
 		logger.Printf(":new mount: %s", client.ClientID.Mount)
 
-		// We don't have a mount yet so we create our own
-		mount := NewMount(mountName)
-
-		// Don't forget to add ourself to the mount map
-		self.Mounts[mountName] = mount
-
-		// Add our new client
-		mount.Clients.Add(client)
-
-		// Since this is a new mount we can set the just added
-		// stream as active
-		mount.Active = client.ClientID
-
-		// We might have saved metadata for this client. Check the storage
-		if meta, ok := self.metaStore[mount.Active.Hash()]; ok {
-			// We cheat again to not duplicate any code! Just send it back into
-			// the processor.
-			self.MetaChan <- &MetaPack{meta, client.ClientID, false}
-		}
-
 		var audio_format string
 		if client.ClientID.AudioFormat == "" {
 			audio_format = "MP3"
@@ -404,28 +1099,202 @@ func (self *Manager) AddClient(client *Client) (err error) {
 			audio_format = client.ClientID.AudioFormat
 		}
 
-		// Don't forget to change the mountname to the client supplied one
-		mount.Shout.ApplyOptions(map[string]string{"mount": mountName,
-			"format": audio_format})
+		// We don't have a mount yet so we create our own
+		mount = NewMount(mountName, audio_format, self.PlayChan)
+
+		// Don't forget to add ourself to the mount map
+		self.Mounts[mountName] = mount
 
 		// We don't open the connection here because that is handled in the
 		// data sending function instead. This keeps the logic simple when
 		// potential disconnects or network issues are involved.
-		return nil
 	}
-	// Mount already exists so all we have to do is add our new client to it.
+
+	// Add our new client
 	mount.Clients.Add(client)
+	mount.emptySince = time.Time{}
 
-	// We want to make sure we don't deadlock if the client queue is full already.
-	if len(mount.ClientQueue) < config.QUEUE_LIMIT {
-		// And push the client onto the queue
-		mount.ClientQueue <- client.ClientID
+	now := time.Now()
+	offSchedule := IsOffSchedule(client.ClientID, now)
+	if offSchedule && config.ScheduleReject {
+		return &OffSchedule{}
+	}
+
+	// Sources coming back aren't new, they are let in even if the mount
+	// doesn't take new ones.
+	old, stale := self.StaleClient(mount, client)
+	resuming := mount.reserved != 0 && mount.reserved == client.ClientID.Hash()
+	if mode := MountMode(mount.Mount); mode != MODE_OPEN && !stale && !resuming {
+		return NewLocked(mount.Mount, mode)
+	}
+
+	if stale {
+		// The encoder reconnected before we noticed the old connection
+		// is gone, the new one takes over its place.
+		self.ReplaceClient(mount, old, client)
+	} else if resuming {
+		// The client came back in time, it gets its slot back.
+		logger.Printf(":grace resume:%s: %s", mount.Mount, client.String())
+		if client.Metadata == "" {
+			client.Metadata = mount.reservedMeta
+		}
+		mount.reserved = 0
+		mount.reservedMeta = ""
+		self.PromoteClient(mount, client)
+	} else if mount.Active == nil && mount.reserved == 0 {
+		// Nobody is live, which is always the case for a new mount, so
+		// there is no reason to put the client in the queue.
+		self.SwapLiveClient(mount, client)
+	} else if IsScheduled(client.ClientID, now) {
+		// It's their show, they don't have to wait for anyone.
+		self.PromoteClient(mount, client)
+	} else if !offSchedule && self.Preempts(mount, client) {
+		logger.Printf(":preempt client:%s: %s", mount.Mount, client.String())
+		self.PromoteClient(mount, client)
+	} else if mount.ClientQueue.Len() < config.QueueLimit(mount.Mount) {
+		// Push the client onto the queue, it goes live after everyone
+		// with a higher or equal priority. Sources that don't belong in
+		// the current slot go live after everyone else.
+		mount.ClientQueue.Push(client.ClientID, SchedulePriority(client, now))
 	} else {
 		return &FullQueue{}
 	}
+
+	// We might have saved metadata for this client. Check the storage
+	if stored, ok := self.metaStore[client.ClientID.Hash()]; ok {
+		delete(self.metaStore, client.ClientID.Hash())
+		// We cheat again to not duplicate any code! Just send it back into
+		// the processor.
+		self.MetaChan <- &MetaPack{Data: stored.Meta.Data, ID: client.ClientID,
+			Original: stored.Meta.Original, Track: stored.Meta.Track,
+			Resent: true}
+	}
 	return nil
 }
 
+/*
+Handles metadata that got through the limiter, see metadataLimiter.
+
+Receiving metadata is slightly complicated because our only method to
+knowing if something is for a specific client is by comparing collected
+variables that we hope generate a unique ID for the client. The
+ClientID.Hash method is here for this specific cause.
+*/
+func (self *Manager) ProcessMetadata(meta *MetaPack) {
+	// Pre compute, since we are bound to use it more than once
+	// in the rest of this block.
+	meta_hash := meta.ID.Hash()
+
+	logger.Printf(":metadata:%x: %s", meta_hash, meta.Data)
+
+	mount, ok := self.Mounts[meta.ID.Mount]
+
+	if !ok {
+		// There is no mountpoint known with the name requested by
+		// the one sending the metadata. We save it temporarily.
+		self.storeMetadata(meta_hash, meta)
+		return
+	}
+
+	// We have a mountpoint with the name, but first have to check
+	// if the active client is sending data or just one of the other
+	// connected ones is. There might not be an active client at all
+	// if the mount is playing its fallback.
+
+	if mount.Active == nil || mount.Active.Hash() != meta_hash {
+		// This means it's one of the other clients sending metadata
+		// Save the metadata for them for when the Active client leaves
+		if client, ok := mount.Clients.GetByHash(meta_hash); ok {
+			client.Metadata = meta.Data
+			client.Track = meta.Track
+			MountHistory(mount.Mount).Add(HistoryEntry{Time: time.Now(),
+				Metadata: meta.Data, Original: meta.Original,
+				Track: meta.Track, User: client.ClientID.Name})
+
+			// Don't forget to call our handler
+			HandleMetadata(client, meta.Data)
+		} else {
+			// We don't seem to have an actual client connected with
+			// this specific identifier, it might connect soon.
+			self.storeMetadata(meta_hash, meta)
+		}
+		return
+	}
+
+	// The active client is sending metadata, we don't have to do much
+	// special for this case, just send it along to icecast and save the
+	// metadata in the Client struct.
+
+	client, ok := mount.Clients.GetByID(mount.Active)
+
+	if !ok {
+		// We... don't seem to have the active client?
+		// Lets drop the packet and just continue on!
+		return
+	}
+
+	if DedupMetadata(mount.Mount) && mount.upstreamMetadata() == meta.Data {
+		logger.Printf(":metadata dropped:%s: %s (duplicate)", mount.Mount,
+			meta.Data)
+		return
+	}
+
+	// Set our metadata, this is mostly done for info gathering by other
+	// code. We don't actually use this value in the client server code.
+	client.Metadata = meta.Data
+	client.Track = meta.Track
+
+	// And send the metadata once the audio received before it has
+	// been sent, we are ignoring errors here
+	// TODO: Check if ignoring errors could lead to problems.
+	entry := HistoryEntry{Metadata: meta.Data, Original: meta.Original,
+		Track: meta.Track, User: client.ClientID.Name}
+	mount.SendMetadata(entry)
+	for _, carrier := range self.Mounts {
+		if carrier.Carrying == mount.Mount {
+			carrier.SendMetadata(entry)
+		}
+	}
+
+	// Call our handler for metadata, we do it here since we
+	// already verified the metadata is fine for sending, there
+	// is no need to wait for the audio.
+	HandleMetadata(client, meta.Data)
+}
+
+/*
+Turns metadata from an input into metadata of the live client of the
+mount, and rewrites it like metadata sent by the client itself. Returns
+false if the metadata should be dropped, such as when nobody is live.
+*/
+func (self *Manager) ResolveLiveMetadata(meta *MetaPack) bool {
+	mount, ok := self.Mounts[meta.ID.Mount]
+	if !ok || mount.Active == nil {
+		logger.Printf(":metadata dropped:%s: nobody is live", meta.ID.Mount)
+		return false
+	}
+
+	meta.ID = mount.Active
+	meta.Live = false
+	meta.Original = meta.Data
+	rewritten, ok := RewriteMetadata(meta.ID, meta.Data)
+	if !ok {
+		logger.Printf(":metadata dropped:%s: %s", meta.ID.Mount, meta.Data)
+		return false
+	}
+	meta.Data = rewritten
+	return true
+}
+
+/*
+Keeps metadata of a client we don't know yet for when it connects, at most
+for config.MetadataTTL. Only the latest metadata of a client is kept.
+*/
+func (self *Manager) storeMetadata(hash ClientHash, meta *MetaPack) {
+	logger.Printf(":metadata stored: %s", meta.Data)
+	self.metaStore[hash] = storedMetadata{Meta: meta, Stored: time.Now()}
+}
+
 func ReadInto(client *Client, dataChan chan<- *DataPack, errChan chan<- *ErrPack) {
 	defer func() {
 		// Function to protect the rest of the runtime from panics in here.
@@ -436,10 +1305,11 @@ func ReadInto(client *Client, dataChan chan<- *DataPack, errChan chan<- *ErrPack
 		}
 	}()
 
+	timeout := config.ReadTimeout(client.ClientID.Mount)
 	for {
 		data := make([]byte, config.BUFFER_SIZE)
 
-		client.Conn.SetReadDeadline(time.Now().Add(config.Timeout))
+		client.Conn.SetReadDeadline(time.Now().Add(timeout))
 		len, err := client.Bufrw.Read(data)
 		if err != nil {
 			// On any errors we just push it onto the error channel
@@ -448,6 +1318,39 @@ func ReadInto(client *Client, dataChan chan<- *DataPack, errChan chan<- *ErrPack
 			return
 		}
 
-		dataChan <- &DataPack{data[:len], client}
+		if client.Meter != nil {
+			// Errors only happen when the meter is closed, which means
+			// the client is being removed already.
+			client.Meter.Write(data[:len])
+		}
+
+		if client.Framer == nil {
+			// We don't know the format, so we can't do better than
+			// passing it on as is.
+			dataChan <- &DataPack{Data: data[:len], Client: client}
+			continue
+		}
+
+		// Only complete frames are passed on, this makes it possible to
+		// switch between clients and insert our own audio cleanly.
+		var frames []byte
+		for _, frame := range client.Framer.Push(data[:len]) {
+			frames = append(frames, frame.Data...)
+		}
+		if frames != nil {
+			dataChan <- &DataPack{Data: frames, Client: client,
+				Headers: client.Framer.Headers()}
+		}
+
+		// Ogg sources can't use the metadata handler, they put the metadata
+		// in the comments of a new stream instead.
+		if comments, ok := client.Framer.Comments(); ok {
+			original := OggMetadata(comments)
+			if meta, ok := RewriteMetadata(client.ClientID, original); ok {
+				ClientManager.MetaChan <- &MetaPack{Data: meta,
+					ID: client.ClientID, Original: original,
+					Track: OggTrack(comments)}
+			}
+		}
 	}
 }
@@ -0,0 +1,227 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Wessie/icecast-proxy-go/config"
+)
+
+// How often watched metadata files are checked for changes.
+const inputPollInterval = time.Second
+
+// The most of a watched file that is read at once.
+const inputReadLimit = 64 * 1024
+
+// The sockets of the metadata inputs, closed by StopInputs.
+var inputSockets []net.Listener
+var inputSocketsLock sync.Mutex
+
+// Closed by StopInputs to stop the goroutines watching files, guarded by
+// inputSocketsLock as well.
+var inputsStop chan struct{}
+
+/*
+Starts reading the metadata inputs of all mounts, see
+config.MetadataInputs. Inputs that can't be started are logged and
+skipped.
+*/
+func StartInputs() {
+	inputSocketsLock.Lock()
+	stop := make(chan struct{})
+	inputsStop = stop
+	inputSocketsLock.Unlock()
+
+	for mount, input := range config.MetadataInputs {
+		if input.File != "" {
+			go watchFile(mount, input, stop)
+		}
+		if input.Socket != "" {
+			listener, err := listenSocket(input.Socket)
+			if err != nil {
+				logger.Printf(":input error:%s: %s", mount, err.Error())
+				continue
+			}
+			inputSocketsLock.Lock()
+			inputSockets = append(inputSockets, listener)
+			inputSocketsLock.Unlock()
+			go acceptSocket(mount, input, listener)
+		}
+	}
+}
+
+/*
+Closes the sockets of the metadata inputs, which removes them, and stops
+watching the files.
+*/
+func StopInputs() {
+	inputSocketsLock.Lock()
+	defer inputSocketsLock.Unlock()
+	for _, listener := range inputSockets {
+		listener.Close()
+	}
+	inputSockets = nil
+	if inputsStop != nil {
+		close(inputsStop)
+		inputsStop = nil
+	}
+}
+
+/*
+Sends a line read from an input to the manager as metadata for the live
+client of the mount.
+*/
+func injectMetadata(mount string, input config.MetadataInput, line string) {
+	line = strings.TrimSpace(ParseMetadata(input.Charset, line))
+	if line == "" {
+		return
+	}
+	ClientManager.MetaChan <- &MetaPack{Data: line,
+		ID: &ClientID{Mount: mount}, Live: true}
+}
+
+/*
+watchFile polls a file for changes. Lines added to the end of the file are
+sent one by one, when the file has been rewritten instead only its last
+line is. Whatever is in the file when we start has been sent before. It
+returns once stop is closed.
+*/
+func watchFile(mount string, input config.MetadataInput, stop <-chan struct{}) {
+	var modified time.Time
+	var size, offset int64
+	// The start of the file as we last read it, used to tell lines being
+	// added from the file being rewritten.
+	var head []byte
+	first := true
+
+	for {
+		info, err := os.Stat(input.File)
+		if err == nil && (!info.ModTime().Equal(modified) || info.Size() != size) {
+			modified, size = info.ModTime(), info.Size()
+			var lines []string
+			lines, head, offset, err = readInput(input.File, head, offset)
+			if !first {
+				for _, line := range lines {
+					injectMetadata(mount, input, line)
+				}
+			}
+		}
+		if err != nil && !os.IsNotExist(err) {
+			logger.Printf(":input error:%s: %s", mount, err.Error())
+		}
+		first = false
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(inputPollInterval):
+		}
+	}
+}
+
+/*
+Reads what changed in a watched file. head is the start of the file as it
+was last read and offset how far it was read, head is nil if the file
+didn't end on a line. Returns the new lines together with the head and
+offset to pass next time.
+*/
+func readInput(path string, head []byte, offset int64) ([]string, []byte, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, head, offset, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, head, offset, err
+	}
+	size := info.Size()
+
+	current := make([]byte, len(head))
+	n, _ := io.ReadFull(f, current)
+
+	// A file shorter than what was read of it has been rewritten, even
+	// if it starts the same
+	if head != nil && size >= offset && bytes.Equal(current[:n], head) {
+		// Lines have been added, if anything
+		if _, err := f.Seek(offset, 0); err != nil {
+			return nil, head, offset, err
+		}
+		data, err := ioutil.ReadAll(io.LimitReader(f, inputReadLimit))
+		if err != nil {
+			return nil, head, offset, err
+		}
+		// Lines still being written are read next time
+		end := bytes.LastIndexByte(data, '\n') + 1
+		lines := strings.Split(string(data[:end]), "\n")
+		return lines, head, offset + int64(end), nil
+	}
+
+	// The file has been rewritten, only the last line is current so the
+	// end of the file is all that is read
+	start := size - inputReadLimit
+	if start < 0 {
+		start = 0
+	}
+	if _, err := f.Seek(start, 0); err != nil {
+		return nil, head, offset, err
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(f, inputReadLimit))
+	if err != nil {
+		return nil, head, offset, err
+	}
+
+	// Nothing can be added to a line that isn't finished, so the next
+	// change to a file that doesn't end on a line is a rewrite too.
+	head = nil
+	if len(data) > 0 && data[len(data)-1] == '\n' {
+		head = make([]byte, 256)
+		if _, err := f.Seek(0, 0); err != nil {
+			return nil, nil, offset, err
+		}
+		n, _ := io.ReadFull(f, head)
+		head = head[:n]
+	}
+	lines := strings.Split(strings.TrimRight(string(data), "\r\n"), "\n")
+	return lines[len(lines)-1:], head, start + int64(len(data)), nil
+}
+
+/*
+Creates the Unix socket of an input, a socket file left behind by an
+earlier run is removed first.
+*/
+func listenSocket(path string) (net.Listener, error) {
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	return net.Listen("unix", path)
+}
+
+/*
+acceptSocket reads metadata from every connection to the socket of an
+input, one line at a time.
+*/
+func acceptSocket(mount string, input config.MetadataInput, listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			// The socket has been closed by StopInputs
+			return
+		}
+		go func() {
+			defer conn.Close()
+			scanner := bufio.NewScanner(conn)
+			for scanner.Scan() {
+				injectMetadata(mount, input, scanner.Text())
+			}
+		}()
+	}
+}
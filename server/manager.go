@@ -1,5 +1,9 @@
 package server
 
+import (
+	"time"
+)
+
 type Manager struct {
 	/* A construct that contains the state used by the
 	   managing of the source client connections */
@@ -11,8 +15,25 @@ type Manager struct {
 	MountCollector chan *Mount
 	// A channel to receive metadata on
 	MetaChan chan *MetaPack
-	// This is a mapping to store a temporary metadata copy
-	metaStore map[ClientHash]string
+	// A channel to receive audio from players on
+	PlayChan chan *PlayPack
+	// A channel to receive actions from the admin interface on
+	AdminChan chan *AdminPack
+	// Metadata of clients that haven't connected yet, see storeMetadata
+	metaStore map[ClientHash]storedMetadata
+	// Holds back metadata sent too fast, see metadataLimiter
+	limiter *metadataLimiter
+}
+
+/*
+storedMetadata is metadata of a client we don't know yet, kept in case it
+connects soon.
+*/
+type storedMetadata struct {
+	// The metadata as it arrived
+	Meta *MetaPack
+	// The time the metadata arrived
+	Stored time.Time
 }
 
 func NewManager() *Manager {
@@ -20,13 +41,18 @@ func NewManager() *Manager {
 	receiver := make(chan *Client, 5)
 	collector := make(chan *Mount, 5)
 	meta := make(chan *MetaPack, 10)
-	metastore := make(map[ClientHash]string, 5)
+	play := make(chan *PlayPack, 10)
+	admin := make(chan *AdminPack, 5)
+	metastore := make(map[ClientHash]storedMetadata, 5)
 
 	return &Manager{Mounts: mounts,
 		Receiver:       receiver,
 		MountCollector: collector,
 		MetaChan:       meta,
-		metaStore:      metastore}
+		PlayChan:       play,
+		AdminChan:      admin,
+		metaStore:      metastore,
+		limiter:        newMetadataLimiter()}
 }
 
 func DestroyManager(self *Manager) {
@@ -34,6 +60,7 @@ func DestroyManager(self *Manager) {
 	close(self.Receiver)
 	close(self.MountCollector)
 	close(self.MetaChan)
+	close(self.AdminChan)
 
 	// metaStore will be garbage collected, no need to get rid of it
 
@@ -43,4 +70,7 @@ func DestroyManager(self *Manager) {
 	for _, mount := range self.Mounts {
 		DestroyMount(mount)
 	}
+
+	// Players send on this, so only close it after the mounts stopped them
+	close(self.PlayChan)
 }
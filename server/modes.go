@@ -0,0 +1,158 @@
+package server
+
+import (
+	"sync"
+)
+
+/*
+Signifies whether new sources are accepted, for the whole proxy or a
+single mount.
+
+The enum below sets the various possible modes.
+*/
+type Mode int8
+
+const (
+	MODE_OPEN   Mode = iota // New sources are accepted
+	MODE_LOCKED             // New sources are rejected, existing ones stay
+	MODE_DRAIN              // Like locked, and shut down once sources are gone
+)
+
+// Names of the modes as used by the admin interface.
+var modeNames = map[Mode]string{
+	MODE_OPEN:   "open",
+	MODE_LOCKED: "locked",
+	MODE_DRAIN:  "drain",
+}
+
+func (self Mode) String() string {
+	return modeNames[self]
+}
+
+/*
+The modes are read by the HTTP handlers to reject sources early and
+changed by the manager, so they live behind their own lock.
+*/
+var modeLock sync.Mutex
+var globalMode Mode
+var mountModes = map[string]Mode{}
+
+/*
+Returns the mode that applies to a mount, the strictest of its own mode
+and the global mode.
+*/
+func MountMode(mount string) Mode {
+	modeLock.Lock()
+	defer modeLock.Unlock()
+
+	if mode := mountModes[mount]; mode > globalMode {
+		return mode
+	}
+	return globalMode
+}
+
+/*
+Returns the global mode and a copy of the modes of all mounts that have
+their own.
+*/
+func Modes() (Mode, map[string]Mode) {
+	modeLock.Lock()
+	defer modeLock.Unlock()
+
+	modes := make(map[string]Mode, len(mountModes))
+	for mount, mode := range mountModes {
+		modes[mount] = mode
+	}
+	return globalMode, modes
+}
+
+/*
+Sets the mode of a mount, or the global mode if the mount is "".
+*/
+func SetMode(mount string, mode Mode) {
+	modeLock.Lock()
+	defer modeLock.Unlock()
+
+	if mount == "" {
+		globalMode = mode
+	} else if mode == MODE_OPEN {
+		delete(mountModes, mount)
+	} else {
+		mountModes[mount] = mode
+	}
+}
+
+/*
+Checks if any draining is done. A draining mount is shut down once its
+last client left, and the proxy itself once the last client of all mounts
+left while draining globally.
+*/
+func (self *Manager) CheckDrain() {
+	global, modes := Modes()
+
+	for name, mode := range modes {
+		mount, ok := self.Mounts[name]
+		if mode != MODE_DRAIN || !ok || mount.Busy() {
+			continue
+		}
+		logger.Printf(":drain finished: %s", name)
+		// The mount stays locked, draining it doesn't mean it's open again
+		SetMode(name, MODE_LOCKED)
+		self.CollectMount(mount)
+	}
+
+	if global != MODE_DRAIN {
+		return
+	}
+	for _, mount := range self.Mounts {
+		if mount.Busy() {
+			return
+		}
+	}
+	logger.Printf(":drain finished: shutting down")
+	for _, mount := range self.Mounts {
+		self.CollectMount(mount)
+	}
+	Shutdown()
+}
+
+/*
+Returns true if the mount still has something to finish before it can be
+drained, a client, a slot held for one or live audio in the delay buffer.
+*/
+func (self *Mount) Busy() bool {
+	return self.Clients.Length > 0 || self.reserved != 0 ||
+		self.Delay != nil && len(self.Delay.entries) > 0
+}
+
+type Locked struct {
+	// The mode that made us reject the client
+	Mode Mode
+	// The mount that is locked, "" if the whole server is
+	Mount string
+}
+
+/*
+Returns the error for a source rejected by the mode of a mount, which
+tells whether the mount or the whole server is locked.
+*/
+func NewLocked(mount string, mode Mode) *Locked {
+	modeLock.Lock()
+	defer modeLock.Unlock()
+
+	if globalMode >= mode {
+		mount = ""
+	}
+	return &Locked{Mode: mode, Mount: mount}
+}
+
+func (self *Locked) Error() string {
+	what := "Server"
+	if self.Mount != "" {
+		what = "Mount " + self.Mount
+	}
+	if self.Mode == MODE_DRAIN {
+		return what + " is shutting down, not accepting new sources."
+	}
+	return what + " is in maintenance mode, not accepting new sources."
+}
@@ -1,38 +1,152 @@
 package server
 
 import (
+	"path"
+	"strings"
+	"time"
+
+	"github.com/Wessie/icecast-proxy-go/audio"
 	"github.com/Wessie/icecast-proxy-go/config"
 	"github.com/Wessie/icecast-proxy-go/shout"
 )
 
 type Mount struct {
-	// The queue of clients
-	ClientQueue chan *ClientID
+	// The queue of clients, highest priority first
+	ClientQueue *SourceQueue
 	// A mapping from identifiers to known source clients
 	Clients *ClientContainer
-	// The currently active client on the stream
+	// The currently active client on the stream, nil if there is none
 	Active *ClientID
 	// The mount we are representing.
 	Mount string
+	// The audio format of the mount, "MP3" or "OGG"
+	Format string
 	// The libshout instance we are using for this mount.
 	Shout *shout.Shout
+	// Sets the comments of Ogg streams, nil for other formats
+	tagger *audio.OggTagger
+	// The latest metadata of the mount, sent again after reconnecting
+	metadata HistoryEntry
+	// Indicates if the latest metadata has reached the icecast server
+	metadataSent bool
+	// Metadata waiting for the live audio in front of it to be sent
+	cues []metadataCue
+	// The amount of live audio that came into the mount, in bytes
+	received uint64
+	// The amount of live audio that has been sent or dropped, in bytes
+	sent uint64
+	// Plays files when no client is live, nil if there is no fallback
+	Fallback *Player
+	// The mount whose audio we send while no client is live, "" if none
+	Carrying string
+	// Plays clips between clients, nil if there are no jingles
+	Jingle *Player
+	// Set while a jingle is playing
+	jingling bool
+	// The last time a jingle started
+	lastJingle time.Time
+	// Live data held back while a jingle is playing, and after it until
+	// it has caught up, see ReleaseHeld
+	held []delayed
+	// How far the held data is behind, set when the jingle finishes
+	heldLag time.Duration
+	// Generates silence when nothing is being sent
+	silence *audio.Silence
+	// Set while we are sending silence
+	filling bool
+	// The point in time up to which silence has been sent
+	fillClock time.Time
+	// The last time we sent data that wasn't silence
+	lastSend time.Time
+	// Set when the next data might start halfway in a stream
+	resync bool
+	// The time the last client left, zero if there are clients
+	emptySince time.Time
+	// Holds back live audio, nil if the mount has no delay
+	Delay *Delay
+	// The channel players of the mount send their audio to
+	plays chan<- *PlayPack
+	// The user owning the current slot of the schedule, "" if none
+	scheduled string
+	// The identity of the live client that lost its connection and
+	// has its slot held, zero if none
+	reserved ClientHash
+	// The time the held slot is given up
+	reservedUntil time.Time
+	// The metadata of the client the slot is held for
+	reservedMeta string
 }
 
-func NewMount(mount string) *Mount {
+func NewMount(mount string, format string, plays chan<- *PlayPack) *Mount {
 	clients := NewClientContainer()
 
-	queue := make(chan *ClientID, config.QUEUE_LIMIT)
+	// The configuration of the mount knows better than the client
+	if configured := config.MountFormat(mount); configured != "" {
+		format = configured
+	}
+
+	// Create a new libshout instance for us, with the settings of the mount
+	sh := shout.NewShout(config.CreateMountShoutMap(mount))
+
+	// Don't forget to change the format to the client supplied one
+	sh.ApplyOptions(map[string]string{"format": format})
+
+	new := Mount{Clients: clients, Mount: mount, Format: format, Shout: sh,
+		ClientQueue: NewSourceQueue(), silence: audio.NewSilence(format),
+		lastJingle: time.Now(), plays: plays}
+
+	if path, ok := config.Fallbacks[mount]; ok {
+		player, err := NewPlayer(&new, path, true)
+		if err != nil {
+			logger.Printf(":fallback error:%s: %s", mount, err.Error())
+		} else {
+			new.Fallback = player
+		}
+	}
 
-	// Create a new libshout instance for us
-	sh := shout.NewShout(config.CreateShoutMap())
+	if jingle, ok := config.Jingles[mount]; ok {
+		player, err := NewPlayer(&new, jingle.Path, true)
+		if err != nil {
+			logger.Printf(":jingle error:%s: %s", mount, err.Error())
+		} else {
+			player.Single = true
+			new.Jingle = player
+		}
+	}
 
-	new := Mount{Clients: clients, Mount: mount, Shout: sh,
-		ClientQueue: queue}
+	if delay, ok := config.Delays[mount]; ok {
+		new.Delay = NewDelay(delay)
+	}
+
+	// libshout can only send metadata for MP3, so for Ogg we change the
+	// comments in the stream itself.
+	if format == "OGG" {
+		new.tagger = audio.NewOggTagger()
+	}
 
 	return &new
 }
 
+/*
+Guesses the audio format of a mount from its name, used for mounts that
+exist before any client told us the format.
+*/
+func FormatFromMount(mount string) string {
+	switch strings.ToLower(path.Ext(mount)) {
+	case ".ogg", ".oga", ".opus":
+		return "OGG"
+	}
+	return "MP3"
+}
+
 func DestroyMount(self *Mount) {
+	if self.Fallback != nil {
+		self.Fallback.Stop()
+	}
+	if self.Jingle != nil {
+		self.Jingle.Stop()
+	}
+
 	shout.DestroyShout(*self.Shout)
 
 	self.Clients.Destroy()
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Wessie/icecast-proxy-go/config"
+	"github.com/Wessie/icecast-proxy-go/http"
+)
+
+// How many updates may wait for a webhook before new ones are dropped.
+const webhookQueue = 16
+
+/*
+NowPlaying is what the now playing JSON file and webhooks get, the history
+entry of the metadata together with its mount.
+*/
+type NowPlaying struct {
+	Mount string `json:"mount"`
+	HistoryEntry
+}
+
+// The updates waiting for each webhook, created on the first update.
+var webhooks map[string]chan []byte
+
+// Starts the goroutines writing the files and calling the webhooks.
+var nowPlayingOnce sync.Once
+
+/*
+nowPlayingFile is the contents of the now playing files of a mount.
+*/
+type nowPlayingFile struct {
+	// The metadata, for the text file
+	metadata string
+	// The NowPlaying as JSON, for the JSON file
+	payload []byte
+}
+
+// The now playing files waiting to be written, by mount. Only the latest
+// update of a mount is kept, the files would be overwritten anyway.
+var nowPlayingFiles = struct {
+	sync.Mutex
+	pending map[string]nowPlayingFile
+	// Signals the writer that there are files pending
+	ready chan struct{}
+}{pending: map[string]nowPlayingFile{}, ready: make(chan struct{}, 1)}
+
+/*
+Tells the now playing outputs what is playing on a mount, see
+config.NowPlayingPath and config.Webhooks. The files are written and the
+webhooks called in the background, this is called by the manager.
+*/
+func PublishNowPlaying(mount string, entry HistoryEntry) {
+	if config.NowPlayingPath == "" && len(config.Webhooks) == 0 {
+		return
+	}
+
+	payload, err := json.Marshal(NowPlaying{Mount: mount, HistoryEntry: entry})
+	if err != nil {
+		logger.Printf(":now playing error:%s: %s", mount, err.Error())
+		return
+	}
+
+	nowPlayingOnce.Do(startNowPlaying)
+	if config.NowPlayingPath != "" {
+		nowPlayingFiles.Lock()
+		nowPlayingFiles.pending[mount] = nowPlayingFile{metadata: entry.Metadata,
+			payload: payload}
+		nowPlayingFiles.Unlock()
+		select {
+		case nowPlayingFiles.ready <- struct{}{}:
+		default:
+			// The writer hasn't picked up the last signal yet
+		}
+	}
+
+	for url, queue := range webhooks {
+		select {
+		case queue <- payload:
+		default:
+			logger.Printf(":webhook dropped:%s: %s", url, entry.Metadata)
+		}
+	}
+}
+
+/*
+writeNowPlaying writes the now playing files whenever there are updates
+pending.
+*/
+func writeNowPlaying() {
+	for range nowPlayingFiles.ready {
+		nowPlayingFiles.Lock()
+		pending := nowPlayingFiles.pending
+		nowPlayingFiles.pending = make(map[string]nowPlayingFile, len(pending))
+		nowPlayingFiles.Unlock()
+
+		for mount, file := range pending {
+			name := filepath.Join(config.NowPlayingPath, mountFileName(mount))
+			if err := writeAtomic(name+".txt", []byte(file.metadata+"\n")); err != nil {
+				logger.Printf(":now playing error:%s: %s", mount, err.Error())
+			}
+			if err := writeAtomic(name+".json", append(file.payload, '\n')); err != nil {
+				logger.Printf(":now playing error:%s: %s", mount, err.Error())
+			}
+		}
+	}
+}
+
+/*
+Writes a file by writing a temporary file next to it and renaming that,
+so readers never see a half written file.
+*/
+func writeAtomic(path string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), ".nowplaying")
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		// Temporary files are only readable by us
+		err = os.Chmod(f.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+func startNowPlaying() {
+	if config.NowPlayingPath != "" {
+		go writeNowPlaying()
+	}
+
+	webhooks = make(map[string]chan []byte, len(config.Webhooks))
+	for _, url := range config.Webhooks {
+		queue := make(chan []byte, webhookQueue)
+		webhooks[url] = queue
+		go callWebhook(url, queue)
+	}
+}
+
+/*
+callWebhook posts the updates for a webhook one after the other, so they
+arrive in order. Failed calls are retried with an increasing pause in
+between.
+*/
+func callWebhook(url string, queue <-chan []byte) {
+	// The deadline covers the whole call, since every call gets a
+	// connection of its own.
+	client := &http.Client{Transport: &http.Transport{
+		DisableKeepAlives: true,
+		Dial: func(network, addr string) (net.Conn, error) {
+			conn, err := net.DialTimeout(network, addr, config.WebhookTimeout)
+			if err == nil {
+				conn.SetDeadline(time.Now().Add(config.WebhookTimeout))
+			}
+			return conn, err
+		}}}
+
+	for payload := range queue {
+		for attempt := 0; ; attempt++ {
+			err := postWebhook(client, url, payload)
+			if err == nil {
+				break
+			}
+			if attempt >= config.WebhookRetries {
+				logger.Printf(":webhook failed:%s: %s", url, err.Error())
+				break
+			}
+			time.Sleep(time.Second << uint(attempt))
+		}
+	}
+}
+
+func postWebhook(client *http.Client, url string, payload []byte) error {
+	resp, err := client.Post(url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
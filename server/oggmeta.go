@@ -0,0 +1,48 @@
+package server
+
+import (
+	"strings"
+
+	"github.com/Wessie/icecast-proxy-go/audio"
+)
+
+/*
+Returns the metadata for the comments of an Ogg stream, in the same
+"Artist - Title" form sources use for MP3 streams. "" is returned if the
+comments have neither.
+*/
+func OggMetadata(comments audio.OggComments) string {
+	artist, title := comments.Get("ARTIST"), comments.Get("TITLE")
+	switch {
+	case artist == "":
+		return title
+	case title == "":
+		return artist
+	}
+	return artist + " - " + title
+}
+
+/*
+Returns the structured form of the comments of an Ogg stream, nil if they
+have neither an artist nor a title.
+*/
+func OggTrack(comments audio.OggComments) *Track {
+	track := &Track{Artist: comments.Get("ARTIST"),
+		Title: comments.Get("TITLE"), Album: comments.Get("ALBUM")}
+	if track.Artist == "" && track.Title == "" {
+		return nil
+	}
+	return track
+}
+
+/*
+Returns the Ogg comments for metadata, the reverse of OggMetadata. Metadata
+without an artist removes the artist comment, since it belongs to a song
+that isn't playing anymore.
+*/
+func OggTags(metadata string) map[string]string {
+	if i := strings.Index(metadata, " - "); i >= 0 {
+		return map[string]string{"ARTIST": metadata[:i], "TITLE": metadata[i+3:]}
+	}
+	return map[string]string{"ARTIST": "", "TITLE": metadata}
+}
@@ -7,8 +7,16 @@ type MetaPack struct {
 	Data string
 	// The client identifier generated by the http server
 	ID *ClientID
-	// Indicates if we've seen this package before
-	Seen bool
+	// The metadata as the client sent it, before any rewriting
+	Original string
+	// The structured form of the metadata, nil if it was sent as text
+	Track *Track
+	// Set for metadata from an input, which is for whichever client is
+	// live on the mount. ID only has the mount set in that case.
+	Live bool
+	// Set for metadata the manager sends itself again, such as when a
+	// client goes live, which isn't rate limited
+	Resent bool
 }
 
 /* DataPack contains a data slice and a pointer to the client that
@@ -21,6 +29,9 @@ type DataPack struct {
 	Data []byte
 	// A pointer to the client that send the data
 	Client *Client
+	// The Ogg header pages of the stream the data belongs to, nil for
+	// other formats
+	Headers []byte
 }
 
 /* ErrPack contains an error and a pointer to the client that generated
@@ -31,3 +42,35 @@ type ErrPack struct {
 	// A pointer to the client that send the data
 	Client *Client
 }
+
+/* PlayPack contains audio read from local files by a Player.
+
+These are generated by the Player goroutine and processed by the manager
+main loop, which decides if the data is still wanted. */
+type PlayPack struct {
+	// The audio data, frame aligned
+	Data []byte
+	// Title of the file starting with this data, "" if none starts
+	Title string
+	// The Ogg header pages of the file the data belongs to, nil for
+	// other formats
+	Headers []byte
+	// Set on the last packet when the player ran out of files
+	Done bool
+	// A pointer to the player that read the data
+	Player *Player
+}
+
+/* AdminPack contains an action requested from the admin interface.
+
+These are generated by the HTTP handlers and processed by the manager main
+loop, since only it is allowed to touch the mounts. */
+type AdminPack struct {
+	// The action to take, such as "dump" or "promote"
+	Action string
+	// The mount the action applies to
+	Mount string
+	// The serial number of the client the action applies to, zero for
+	// actions on the mount itself
+	Client uint64
+}
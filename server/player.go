@@ -0,0 +1,301 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Wessie/icecast-proxy-go/audio"
+	"github.com/dhowden/tag"
+)
+
+// How far ahead of real time a Player sends its audio.
+const playerLead = time.Millisecond * 500
+
+// File extensions we consider playable for each format.
+var playableExtensions = map[string][]string{
+	"MP3": {".mp3"},
+	"OGG": {".ogg", ".oga", ".opus"},
+}
+
+/*
+Player plays a list of local audio files on a mount.
+
+The files are read in their own goroutine, split into frames and sent to
+the manager at the speed they would be played at. The manager decides
+what happens with the data, a Player doesn't touch the mount itself.
+*/
+type Player struct {
+	// The mount the audio is meant for
+	Mount *Mount
+	// The files to play, in order
+	Files []string
+	// Start over at the first file after the last one
+	Loop bool
+	// Stop after playing a single file
+	Single bool
+	// The index of the next file to play, only used by the goroutine
+	position int
+	// Closed to make the goroutine stop
+	quit chan bool
+	// Closed by the goroutine when it stopped
+	done chan bool
+}
+
+/*
+Creates a new Player for the mount from an audio file, a directory or a
+playlist file.
+
+A directory plays all files in it with an extension matching the format,
+sorted by name. Files that don't have such an extension are read as a
+playlist with a path on each line, empty lines and lines starting with '#'
+are ignored. Relative paths are relative to the directory of the playlist,
+and entries without an extension matching the format are skipped.
+*/
+func NewPlayer(mount *Mount, path string, loop bool) (*Player, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	if info.IsDir() {
+		files, err = readDirectory(path, mount.Format)
+	} else if isPlayable(path, mount.Format) {
+		files = []string{path}
+	} else {
+		files, err = readPlaylist(path, mount.Format)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &Player{Mount: mount, Files: files, Loop: loop}, nil
+}
+
+func readDirectory(path string, format string) ([]string, error) {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() && isPlayable(entry.Name(), format) {
+			files = append(files, filepath.Join(path, entry.Name()))
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func isPlayable(path string, format string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	for _, playable := range playableExtensions[format] {
+		if ext == playable {
+			return true
+		}
+	}
+	return false
+}
+
+func readPlaylist(path string, format string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	files := make([]string, 0, 20)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if !filepath.IsAbs(line) {
+			line = filepath.Join(filepath.Dir(path), line)
+		}
+		if !isPlayable(line, format) {
+			// Upstream expects a single format, anything else would
+			// corrupt the stream.
+			logger.Printf(":player skipped:%s: %s isn't %s", path, line, format)
+			continue
+		}
+		files = append(files, line)
+	}
+	return files, scanner.Err()
+}
+
+/*
+Starts playing, the audio is sent to the channel given. Calling Start on a
+running Player does nothing. Playing continues with the file after the one
+that was playing when it was stopped.
+*/
+func (self *Player) Start(out chan<- *PlayPack) {
+	if self.Running() {
+		return
+	}
+	self.quit = make(chan bool)
+	self.done = make(chan bool)
+	go self.run(out, self.quit, self.done)
+}
+
+/*
+Stops playing and waits until the goroutine is gone. Calling Stop on a
+Player that isn't running does nothing.
+*/
+func (self *Player) Stop() {
+	if !self.Running() {
+		return
+	}
+	close(self.quit)
+	<-self.done
+	self.quit, self.done = nil, nil
+}
+
+/*
+Returns true if the Player has been started and didn't stop yet. A Player
+that played all its files without looping isn't running anymore.
+*/
+func (self *Player) Running() bool {
+	if self.done == nil {
+		return false
+	}
+	select {
+	case <-self.done:
+		return false
+	default:
+		return true
+	}
+}
+
+func (self *Player) run(out chan<- *PlayPack, quit chan bool, done chan bool) {
+	defer close(done)
+
+	clock := time.Now()
+	failed := 0
+	for failed < len(self.Files) {
+		if self.position >= len(self.Files) {
+			if !self.Loop {
+				break
+			}
+			self.position = 0
+		}
+
+		path := self.Files[self.position]
+		self.position++
+
+		played, err := self.play(path, out, quit, &clock)
+		if err != nil {
+			logger.Printf(":player error:%s: %s (error: %s)",
+				self.Mount.Mount, path, err.Error())
+		}
+		if played {
+			failed = 0
+			if self.Single {
+				break
+			}
+		} else {
+			failed++
+		}
+
+		select {
+		case <-quit:
+			return
+		default:
+		}
+	}
+
+	// Let the manager know we ran out of things to play
+	select {
+	case out <- &PlayPack{Player: self, Done: true}:
+	case <-quit:
+	}
+}
+
+/*
+Plays a single file, returns true if any audio of it was sent.
+*/
+func (self *Player) play(path string, out chan<- *PlayPack, quit chan bool,
+	clock *time.Time) (played bool, err error) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	title := readTitle(f, path)
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+
+	framer := audio.NewFramer(self.Mount.Format)
+	buffer := make([]byte, 4096)
+	for {
+		n, err := f.Read(buffer)
+		if n > 0 {
+			var data []byte
+			var duration time.Duration
+			for _, frame := range framer.Push(buffer[:n]) {
+				data = append(data, frame.Data...)
+				duration += frame.Duration
+			}
+
+			if len(data) > 0 {
+				// We don't want to catch up on time we were stopped for.
+				if now := time.Now(); clock.Before(now) {
+					*clock = now
+				}
+
+				timer := time.NewTimer(time.Until(clock.Add(-playerLead)))
+				select {
+				case <-timer.C:
+				case <-quit:
+					timer.Stop()
+					return played, nil
+				}
+
+				select {
+				case out <- &PlayPack{Data: data, Title: title, Player: self,
+					Headers: framer.Headers()}:
+				case <-quit:
+					return played, nil
+				}
+
+				*clock = clock.Add(duration)
+				title = ""
+				played = true
+			}
+		}
+
+		if err == io.EOF {
+			return played, nil
+		} else if err != nil {
+			return played, err
+		}
+	}
+}
+
+/*
+Returns the title of the file from its tags, or the file name if there is
+no usable tag.
+*/
+func readTitle(f *os.File, path string) string {
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+
+	meta, err := tag.ReadFrom(f)
+	if err != nil || meta.Title() == "" {
+		return name
+	}
+
+	if artist := meta.Artist(); artist != "" {
+		return artist + " - " + meta.Title()
+	}
+	return meta.Title()
+}
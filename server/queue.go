@@ -0,0 +1,212 @@
+package server
+
+import (
+	"strings"
+	"time"
+
+	"github.com/Wessie/icecast-proxy-go/config"
+)
+
+// Names used for the permission levels in the priority configuration.
+var permissionNames = map[Permission]string{
+	PERM_NONE:   "none",
+	PERM_META:   "meta",
+	PERM_SOURCE: "source",
+	PERM_ADMIN:  "admin",
+}
+
+/*
+Returns the queue priority of a client, the per-user setting wins over the
+one of the permission level.
+*/
+func PriorityOf(id *ClientID) int {
+	if priority, ok := config.UserPriorities[strings.ToLower(id.Name)]; ok {
+		return priority
+	}
+	return config.PermissionPriorities[permissionNames[id.Perm]]
+}
+
+/*
+QueueEntry is a single source waiting in the queue of a mount.
+*/
+type QueueEntry struct {
+	// The client that is waiting
+	ID *ClientID
+	// Entries with a higher priority go live first
+	Priority int
+	// The time the client was put in the queue
+	Since time.Time
+}
+
+/*
+SourceQueue contains the sources waiting to go live on a mount.
+
+The entries are kept sorted by priority, entries with the same priority
+are kept in the order they were added. This type is not thread-safe, it
+belongs to the manager main loop like the rest of the mount.
+*/
+type SourceQueue struct {
+	entries []QueueEntry
+}
+
+func NewSourceQueue() *SourceQueue {
+	return &SourceQueue{entries: make([]QueueEntry, 0, 5)}
+}
+
+/*
+Returns the amount of waiting sources.
+*/
+func (self *SourceQueue) Len() int {
+	return len(self.entries)
+}
+
+/*
+Adds a client behind all entries with the same or a higher priority.
+*/
+func (self *SourceQueue) Push(id *ClientID, priority int) {
+	i := len(self.entries)
+	for i > 0 && self.entries[i-1].Priority < priority {
+		i--
+	}
+	self.insert(i, QueueEntry{ID: id, Priority: priority, Since: time.Now()})
+}
+
+/*
+Adds a client in front of all entries with the same or a lower priority.
+*/
+func (self *SourceQueue) PushFront(id *ClientID, priority int) {
+	i := 0
+	for i < len(self.entries) && self.entries[i].Priority > priority {
+		i++
+	}
+	self.insert(i, QueueEntry{ID: id, Priority: priority, Since: time.Now()})
+}
+
+/*
+Gives every entry the priority returned for it and puts the queue back in
+priority order. Entries with the same priority keep their order and the
+time they were queued.
+*/
+func (self *SourceQueue) Reprioritise(priority func(id *ClientID) int) {
+	entries := self.entries
+	self.entries = make([]QueueEntry, 0, cap(entries))
+	for _, entry := range entries {
+		entry.Priority = priority(entry.ID)
+		i := len(self.entries)
+		for i > 0 && self.entries[i-1].Priority < entry.Priority {
+			i--
+		}
+		self.insert(i, entry)
+	}
+}
+
+func (self *SourceQueue) insert(i int, entry QueueEntry) {
+	self.entries = append(self.entries, QueueEntry{})
+	copy(self.entries[i+1:], self.entries[i:])
+	self.entries[i] = entry
+}
+
+/*
+Removes and returns the entry that should go live next, the second return
+value is false if the queue is empty.
+*/
+func (self *SourceQueue) Pop() (entry QueueEntry, ok bool) {
+	if len(self.entries) == 0 {
+		return entry, false
+	}
+	entry = self.entries[0]
+	self.entries[0] = QueueEntry{}
+	self.entries = self.entries[1:]
+	return entry, true
+}
+
+/*
+Returns the entry that would go live next without removing it, the second
+return value is false if the queue is empty.
+*/
+func (self *SourceQueue) Peek() (entry QueueEntry, ok bool) {
+	if len(self.entries) == 0 {
+		return entry, false
+	}
+	return self.entries[0], true
+}
+
+/*
+Removes a client from the queue, returns false if it wasn't in there.
+*/
+func (self *SourceQueue) Remove(id *ClientID) bool {
+	for i, entry := range self.entries {
+		if entry.ID == id {
+			self.entries = append(self.entries[:i], self.entries[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Moves a client the amount of places given towards the front of the queue,
+negative amounts move it towards the back. A client that passes others
+takes over their priority, this keeps the queue in priority order. Returns
+false if the client isn't queued.
+*/
+func (self *SourceQueue) Move(id *ClientID, places int) bool {
+	i := self.Position(id)
+	if i < 0 {
+		return false
+	}
+
+	for ; places > 0 && i > 0; places-- {
+		self.swap(i, i-1)
+		i--
+	}
+	for ; places < 0 && i < len(self.entries)-1; places++ {
+		self.swap(i, i+1)
+		i++
+	}
+	return true
+}
+
+/*
+Swaps the clients in two places of the queue, the priorities stay where
+they are.
+*/
+func (self *SourceQueue) swap(i, j int) {
+	a, b := &self.entries[i], &self.entries[j]
+	a.ID, b.ID = b.ID, a.ID
+	a.Since, b.Since = b.Since, a.Since
+}
+
+/*
+Puts a client in the place of another one in the queue, returns false if
+the old client isn't queued.
+*/
+func (self *SourceQueue) Replace(old *ClientID, new *ClientID) bool {
+	i := self.Position(old)
+	if i < 0 {
+		return false
+	}
+	self.entries[i].ID = new
+	return true
+}
+
+/*
+Returns a copy of the entries in the queue, in the order they would go
+live.
+*/
+func (self *SourceQueue) Entries() []QueueEntry {
+	return append([]QueueEntry(nil), self.entries...)
+}
+
+/*
+Returns the position of a client in the queue starting at zero, -1 is
+returned if it isn't queued.
+*/
+func (self *SourceQueue) Position(id *ClientID) int {
+	for i, entry := range self.entries {
+		if entry.ID == id {
+			return i
+		}
+	}
+	return -1
+}
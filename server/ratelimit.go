@@ -0,0 +1,249 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Wessie/icecast-proxy-go/config"
+)
+
+/*
+tokenBucket counts the updates left of a config.RateLimit.
+*/
+type tokenBucket struct {
+	// The updates left, fractions of an update build up over time
+	tokens float64
+	// The time tokens was last brought up to date
+	updated time.Time
+}
+
+func newTokenBucket(limit config.RateLimit, now time.Time) *tokenBucket {
+	return &tokenBucket{tokens: float64(limit.Burst), updated: now}
+}
+
+/*
+Adds the tokens gained since the last call and returns true if the bucket
+has an update left.
+*/
+func (self *tokenBucket) ready(limit config.RateLimit, now time.Time) bool {
+	if limit.Interval <= 0 {
+		return true
+	}
+	self.tokens += float64(now.Sub(self.updated)) / float64(limit.Interval)
+	if self.tokens > float64(limit.Burst) {
+		self.tokens = float64(limit.Burst)
+	}
+	self.updated = now
+	return self.tokens >= 1
+}
+
+/*
+Uses up an update, the bucket should be ready.
+*/
+func (self *tokenBucket) take(limit config.RateLimit) {
+	if limit.Interval > 0 {
+		self.tokens--
+	}
+}
+
+/*
+Returns true if the bucket is back to its full burst, which makes it the
+same as a new one.
+*/
+func (self *tokenBucket) full(limit config.RateLimit, now time.Time) bool {
+	self.ready(limit, now)
+	return self.tokens >= float64(limit.Burst)
+}
+
+/*
+metadataLimiter holds back metadata of sources and mounts that update it
+faster than config.ClientMetadataLimit and config.MountMetadataLimit allow.
+Only the latest metadata held back for a source is kept, the updates it
+replaces are counted as dropped. A burst that ends on the metadata let
+through before it is dropped as a whole.
+*/
+type metadataLimiter struct {
+	clients map[ClientHash]*tokenBucket
+	mounts  map[string]*tokenBucket
+	// The metadata held back, in the order it arrived
+	held []*MetaPack
+	// The metadata of each source that was let through last
+	passed map[ClientHash]string
+}
+
+func newMetadataLimiter() *metadataLimiter {
+	return &metadataLimiter{clients: make(map[ClientHash]*tokenBucket),
+		mounts: make(map[string]*tokenBucket),
+		passed: make(map[ClientHash]string)}
+}
+
+/*
+Returns true if the metadata may be used right away. Otherwise it is held
+until Release returns it.
+*/
+func (self *metadataLimiter) Allow(meta *MetaPack, now time.Time) bool {
+	hash := meta.ID.Hash()
+	for i, held := range self.held {
+		if held.ID.Hash() == hash {
+			countDroppedMetadata(held)
+			if meta.Data == self.passed[hash] {
+				// The burst ended where it started, there is nothing
+				// left to send.
+				copy(self.held[i:], self.held[i+1:])
+				self.held[len(self.held)-1] = nil
+				self.held = self.held[:len(self.held)-1]
+				return false
+			}
+			// Keep its place so a busy mount can't starve it
+			self.held[i] = meta
+			return false
+		}
+	}
+
+	if !self.take(meta, now) {
+		self.held = append(self.held, meta)
+		return false
+	}
+	self.passed[hash] = meta.Data
+	return true
+}
+
+/*
+Returns the metadata held back that may be used now, oldest first.
+*/
+func (self *metadataLimiter) Release(now time.Time) []*MetaPack {
+	var released []*MetaPack
+	kept := self.held[:0]
+	for _, meta := range self.held {
+		if self.take(meta, now) {
+			released = append(released, meta)
+			self.passed[meta.ID.Hash()] = meta.Data
+		} else {
+			kept = append(kept, meta)
+		}
+	}
+	for i := len(kept); i < len(self.held); i++ {
+		self.held[i] = nil
+	}
+	self.held = kept
+	return released
+}
+
+/*
+Forgets the buckets that have filled up again, they are the same as new
+ones by then.
+*/
+func (self *metadataLimiter) Prune(now time.Time) {
+	for hash, bucket := range self.clients {
+		if bucket.full(config.ClientMetadataLimit, now) && !self.holds(hash) {
+			delete(self.clients, hash)
+			delete(self.passed, hash)
+		}
+	}
+	for mount, bucket := range self.mounts {
+		if bucket.full(config.MountMetadataLimit, now) {
+			delete(self.mounts, mount)
+		}
+	}
+}
+
+/*
+Drops the metadata held back for a source that left, it would otherwise be
+kept for a client that is gone.
+*/
+func (self *metadataLimiter) Forget(hash ClientHash) {
+	kept := self.held[:0]
+	for _, meta := range self.held {
+		if meta.ID.Hash() == hash {
+			logger.Printf(":metadata dropped:%s: %s (source left)", meta.ID.Mount,
+				meta.Data)
+			continue
+		}
+		kept = append(kept, meta)
+	}
+	for i := len(kept); i < len(self.held); i++ {
+		self.held[i] = nil
+	}
+	self.held = kept
+}
+
+func (self *metadataLimiter) holds(hash ClientHash) bool {
+	for _, meta := range self.held {
+		if meta.ID.Hash() == hash {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Uses up an update of both the source and the mount of the metadata, if
+both have one left.
+*/
+func (self *metadataLimiter) take(meta *MetaPack, now time.Time) bool {
+	hash := meta.ID.Hash()
+	client, ok := self.clients[hash]
+	if !ok {
+		client = newTokenBucket(config.ClientMetadataLimit, now)
+		self.clients[hash] = client
+	}
+	mount, ok := self.mounts[meta.ID.Mount]
+	if !ok {
+		mount = newTokenBucket(config.MountMetadataLimit, now)
+		self.mounts[meta.ID.Mount] = mount
+	}
+
+	if !client.ready(config.ClientMetadataLimit, now) ||
+		!mount.ready(config.MountMetadataLimit, now) {
+		return false
+	}
+	client.take(config.ClientMetadataLimit)
+	mount.take(config.MountMetadataLimit)
+	return true
+}
+
+// The amount of metadata updates dropped by the limiter, by mount and by
+// source, shown on the admin page.
+var droppedMetadata = struct {
+	sync.Mutex
+	mounts  map[string]uint64
+	clients map[ClientHash]uint64
+}{mounts: map[string]uint64{}, clients: map[ClientHash]uint64{}}
+
+func countDroppedMetadata(meta *MetaPack) {
+	logger.Printf(":metadata dropped:%s: %s (rate limited)", meta.ID.Mount,
+		meta.Data)
+	droppedMetadata.Lock()
+	droppedMetadata.mounts[meta.ID.Mount]++
+	droppedMetadata.clients[meta.ID.Hash()]++
+	droppedMetadata.Unlock()
+}
+
+/*
+Returns how many metadata updates of the mount have been dropped for being
+sent too fast.
+*/
+func MountMetadataDropped(mount string) uint64 {
+	droppedMetadata.Lock()
+	defer droppedMetadata.Unlock()
+	return droppedMetadata.mounts[mount]
+}
+
+/*
+Returns how many metadata updates of the client have been dropped for
+being sent too fast.
+*/
+func ClientMetadataDropped(client *Client) uint64 {
+	droppedMetadata.Lock()
+	defer droppedMetadata.Unlock()
+	return droppedMetadata.clients[client.ClientID.Hash()]
+}
+
+/*
+Forgets the count of a client that disconnected.
+*/
+func forgetDroppedMetadata(client *Client) {
+	droppedMetadata.Lock()
+	delete(droppedMetadata.clients, client.ClientID.Hash())
+	droppedMetadata.Unlock()
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"strings"
+
+	"github.com/Wessie/icecast-proxy-go/config"
+)
+
+/*
+Returns the metadata rules of a mount, see config.MetadataRules.
+*/
+func metadataRules(mount string) []config.MetadataRule {
+	rules, ok := config.MetadataRules[mount]
+	if !ok {
+		rules = config.MetadataRules["default"]
+	}
+	return rules
+}
+
+/*
+Runs metadata sent by a client through the rules of its mount, see
+config.MetadataRules. Returns the rewritten metadata, the second return
+value is false if the metadata should be dropped.
+
+The dedup rule is left to the manager, which knows what went upstream, see
+DedupMetadata.
+*/
+func RewriteMetadata(clientID *ClientID, meta string) (string, bool) {
+	for _, rule := range metadataRules(clientID.Mount) {
+		switch rule.Kind {
+		case "replace":
+			meta = rule.Pattern.ReplaceAllString(meta, rule.Text)
+		case "template":
+			meta = strings.NewReplacer("{song}", meta, "{dj}", clientID.Name,
+				"{mount}", clientID.Mount).Replace(rule.Text)
+		case "limit":
+			// Count characters, not bytes, we don't want to cut one in half
+			if runes := []rune(meta); len(runes) > rule.Limit {
+				meta = string(runes[:rule.Limit])
+			}
+		case "block":
+			if rule.Pattern.MatchString(meta) {
+				logger.Printf(":metadata blocked:%s: %s", clientID.Mount, meta)
+				return meta, false
+			}
+		}
+	}
+
+	meta = strings.TrimSpace(meta)
+	if meta == "" {
+		return meta, false
+	}
+	return meta, true
+}
+
+/*
+Returns true if the mount has a dedup rule.
+*/
+func DedupMetadata(mount string) bool {
+	for _, rule := range metadataRules(mount) {
+		if rule.Kind == "dedup" {
+			return true
+		}
+	}
+	return false
+}
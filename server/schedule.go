@@ -0,0 +1,99 @@
+package server
+
+import (
+	"math"
+	"strings"
+	"time"
+
+	"github.com/Wessie/icecast-proxy-go/config"
+)
+
+// The queue priority of sources connecting during the slot of someone else.
+const offSchedulePriority = math.MinInt32
+
+/*
+Returns the user owning the mount at the time given according to the
+schedule, the second return value is false if there is no such slot.
+*/
+func ScheduledUser(mount string, now time.Time) (string, bool) {
+	for _, slot := range config.Schedule[mount] {
+		if slot.Contains(now) {
+			return slot.User, true
+		}
+	}
+	return "", false
+}
+
+/*
+Returns true if the client owns the current slot of its mount.
+*/
+func IsScheduled(id *ClientID, now time.Time) bool {
+	user, ok := ScheduledUser(id.Mount, now)
+	return ok && strings.EqualFold(user, id.Name)
+}
+
+/*
+Returns true if the client connected during the slot of someone else.
+Admins are never off schedule.
+*/
+func IsOffSchedule(id *ClientID, now time.Time) bool {
+	user, ok := ScheduledUser(id.Mount, now)
+	return ok && !strings.EqualFold(user, id.Name) && id.Perm < PERM_ADMIN
+}
+
+/*
+Returns the queue priority of a client at the time given, sources that
+don't belong in the current slot go after everyone else.
+*/
+func SchedulePriority(client *Client, now time.Time) int {
+	if IsOffSchedule(client.ClientID, now) {
+		return offSchedulePriority
+	}
+	return client.Priority
+}
+
+/*
+Follows the schedule of the mount, this makes the owner of a slot that
+just started live and demotes the owner of a slot that just ended if
+configured to do so. The queue is put in the order of the new slot.
+*/
+func (self *Manager) CheckSchedule(mount *Mount, now time.Time) {
+	user, _ := ScheduledUser(mount.Mount, now)
+	if user == mount.scheduled {
+		return
+	}
+	previous := mount.scheduled
+	mount.scheduled = user
+	logger.Printf(":schedule:%s: '%s' -> '%s'", mount.Mount, previous, user)
+
+	mount.ClientQueue.Reprioritise(func(id *ClientID) int {
+		client, ok := mount.Clients.GetByID(id)
+		if !ok {
+			// Gone already, it is skipped when its turn comes
+			return offSchedulePriority
+		}
+		return SchedulePriority(client, now)
+	})
+	self.QueueChanged(mount)
+
+	if user != "" {
+		if client, ok := mount.Clients.GetByName(user); ok {
+			self.PromoteClient(mount, client)
+			return
+		}
+	}
+
+	if previous == "" || !config.ScheduleDemote {
+		return
+	}
+	if active, ok := mount.Clients.GetByID(mount.Active); ok &&
+		strings.EqualFold(active.ClientID.Name, previous) {
+		self.DemoteLiveClient(mount, active)
+	}
+}
+
+type OffSchedule struct{}
+
+func (self *OffSchedule) Error() string {
+	return "Client is not on the schedule, discarding client."
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Wessie/icecast-proxy-go/config"
+)
+
+/*
+Track is the structured form of metadata, as sent to the JSON metadata
+handler or embedded in Ogg streams. The metadata sent upstream is rendered
+from it, see Render.
+*/
+type Track struct {
+	Artist string `json:"artist,omitempty"`
+	Title  string `json:"title,omitempty"`
+	Album  string `json:"album,omitempty"`
+	// The URL of the cover art
+	Artwork string `json:"artwork,omitempty"`
+	// The length of the track in seconds, zero if unknown
+	Duration float64 `json:"duration,omitempty"`
+}
+
+// The characters separating fields in a template, see Track.Render.
+const trackSeparators = " -–—/|:,;·"
+
+// The brackets a field in a template can be put between.
+var trackBrackets = map[byte]byte{'(': ')', '[': ']', '{': '}', '<': '>'}
+
+/*
+Renders the track with the template given, see config.MetadataTemplate.
+The separator or brackets next to a field that is empty are removed along
+with it, the fields themselves are used as they are.
+*/
+func (self *Track) Render(template string) string {
+	duration := ""
+	if self.Duration > 0 {
+		length := time.Duration(self.Duration) * time.Second
+		duration = fmt.Sprintf("%d:%02d", length/time.Minute,
+			length%time.Minute/time.Second)
+	}
+	values := map[string]string{"artist": self.Artist, "title": self.Title,
+		"album": self.Album, "duration": duration}
+
+	// Split the template into the text between fields and the fields, so
+	// the parts at odd indexes are fields.
+	var parts []string
+	literal := ""
+	for {
+		start := strings.IndexByte(template, '{')
+		length := strings.IndexByte(template[start+1:], '}')
+		if start < 0 || length < 0 {
+			break
+		}
+		end := start + 1 + length
+		value, ok := values[template[start+1:end]]
+		if !ok {
+			literal += template[:end+1]
+			template = template[end+1:]
+			continue
+		}
+		parts = append(parts, literal+template[:start], value)
+		literal = ""
+		template = template[end+1:]
+	}
+	parts = append(parts, literal+template)
+
+	filled := false
+	for i := 1; i < len(parts); i += 2 {
+		if parts[i] != "" {
+			filled = true
+			continue
+		}
+		before, after := parts[i-1], parts[i+1]
+		if n := len(before); n > 0 && len(after) > 0 &&
+			trackBrackets[before[n-1]] == after[0] {
+			before, after = before[:n-1], after[1:]
+		}
+		// The separator goes between the field and whatever came before,
+		// or whatever comes after if it is the first field.
+		if filled {
+			before = strings.TrimRight(before, trackSeparators)
+		} else {
+			after = strings.TrimLeft(after, trackSeparators)
+		}
+		parts[i-1], parts[i+1] = before, after
+	}
+	return strings.TrimSpace(strings.Join(parts, ""))
+}
+
+/*
+Returns the metadata to send upstream for the track, rendered with the
+template of the metadata configuration.
+*/
+func (self *Track) Metadata() string {
+	return self.Render(config.MetadataTemplate)
+}